@@ -0,0 +1,179 @@
+package spn
+
+// linearSearch is the state of a search for invertible linear maps A and B with s2 = B∘s1∘A, where s1 and s2 send 0 to
+// 0. A and B are known on the spans of aKnown and bKnown, and -1 elsewhere. Known points from aDone and bDone on haven't
+// been propagated yet.
+type linearSearch struct {
+	s1, s2 SBox
+
+	a, aInv, b, bInv []int32
+	aKnown, bKnown   []uint16
+	aDone, bDone     int
+}
+
+// newLinearSearch returns a search with A and B only known at 0.
+func newLinearSearch(s1, s2 SBox) *linearSearch {
+	n := len(s1.EncKey)
+	ls := &linearSearch{
+		s1: s1, s2: s2,
+		a: make([]int32, n), aInv: make([]int32, n), b: make([]int32, n), bInv: make([]int32, n),
+		aKnown: []uint16{0}, bKnown: []uint16{0}, aDone: 1, bDone: 1,
+	}
+
+	for _, table := range [][]int32{ls.a, ls.aInv, ls.b, ls.bInv} {
+		for i := range table {
+			table[i] = -1
+		}
+		table[0] = 0
+	}
+
+	return ls
+}
+
+// extend sets f(x) = y, where x and y aren't in the spans of the points f and fInv are known at, and extends f linearly.
+func extend(f, fInv []int32, known *[]uint16, x, y uint16) {
+	for _, k := range *known {
+		nx, ny := k^x, uint16(f[k])^y
+		f[nx], fInv[ny] = int32(ny), int32(nx)
+		*known = append(*known, nx)
+	}
+}
+
+// set records that f(x) = y, and returns false if it contradicts what's known about f.
+func set(f, fInv []int32, known *[]uint16, x, y uint16) bool {
+	if f[x] != -1 {
+		return f[x] == int32(y)
+	} else if fInv[y] != -1 {
+		return false
+	}
+
+	extend(f, fInv, known, x, y)
+	return true
+}
+
+// propagate works out everything that follows from the known points, and returns false on a contradiction. Each point
+// where A is known gives a point where B is, since B(s1(A(x))) = s2(x), and each point where B is known gives one where
+// A is, since A(s2^-1(B(y))) = s1^-1(y).
+func (ls *linearSearch) propagate() bool {
+	for ls.aDone < len(ls.aKnown) || ls.bDone < len(ls.bKnown) {
+		for ; ls.aDone < len(ls.aKnown); ls.aDone++ {
+			x := ls.aKnown[ls.aDone]
+			if !set(ls.b, ls.bInv, &ls.bKnown, ls.s1.Encode(uint16(ls.a[x])), ls.s2.Encode(x)) {
+				return false
+			}
+		}
+
+		for ; ls.bDone < len(ls.bKnown); ls.bDone++ {
+			y := ls.bKnown[ls.bDone]
+			if !set(ls.a, ls.aInv, &ls.aKnown, ls.s2.Decode(uint16(ls.b[y])), ls.s1.Decode(y)) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// undo forgets every point learned since A was known on aLen points and B on bLen.
+func (ls *linearSearch) undo(aLen, bLen int) {
+	for _, x := range ls.aKnown[aLen:] {
+		ls.aInv[ls.a[x]], ls.a[x] = -1, -1
+	}
+	for _, y := range ls.bKnown[bLen:] {
+		ls.bInv[ls.b[y]], ls.b[y] = -1, -1
+	}
+
+	ls.aKnown, ls.bKnown = ls.aKnown[:aLen], ls.bKnown[:bLen]
+}
+
+// search propagates what's known, and then guesses A on the smallest point where it's unknown, calling found with every
+// complete solution until it returns false. It returns false if the search was stopped.
+func (ls *linearSearch) search(found func(a, b []int32) bool) bool {
+	aLen, bLen, aDone, bDone := len(ls.aKnown), len(ls.bKnown), ls.aDone, ls.bDone
+	defer func() {
+		ls.undo(aLen, bLen)
+		ls.aDone, ls.bDone = aDone, bDone
+	}()
+
+	if !ls.propagate() {
+		return true
+	} else if len(ls.aKnown) == len(ls.a) {
+		return found(ls.a, ls.b)
+	}
+
+	x := 0
+	for ls.a[x] != -1 {
+		x++
+	}
+
+	guessALen, guessBLen := len(ls.aKnown), len(ls.bKnown)
+	for y := range ls.aInv {
+		if ls.aInv[y] != -1 {
+			continue
+		}
+
+		extend(ls.a, ls.aInv, &ls.aKnown, uint16(x), uint16(y))
+		if !ls.search(found) {
+			return false
+		}
+		ls.undo(guessALen, guessBLen)
+	}
+
+	return true
+}
+
+// AffineEquivalence is a pair of invertible affine maps relating two S-boxes: the second is B∘S∘A, where S is the first.
+type AffineEquivalence struct {
+	A, B AffineMap
+}
+
+// AffineEquivalences returns every pair of invertible affine maps A and B with s2 = B∘s1∘A, or none if the S-boxes
+// aren't affine equivalent. It returns ErrSBoxSize if they have different widths, and ErrTooManyEquivalences if there
+// are more than limit pairs, which happens when the S-boxes have many self-equivalences--affine S-boxes have
+// astronomically many.
+//
+// It's the algorithm of Biryukov, De Cannière, Braeken, and Preneel. For each value of A(0), it looks for linear maps
+// relating the S-boxes translated to send 0 to 0, guessing A on one point at a time and working out everything that
+// follows from linearity until it finds a contradiction or a solution. Every value of A(0) has to be tried, so for 8-bit
+// S-boxes it takes several seconds whether or not they're equivalent.
+func AffineEquivalences(s1, s2 SBox, limit int) ([]AffineEquivalence, error) {
+	if s1.Width() != s2.Width() {
+		return nil, ErrSBoxSize
+	}
+	width, n := s1.Width(), len(s1.EncKey)
+
+	target := make([]uint16, n)
+	for x := range target {
+		target[x] = s2.Encode(uint16(x)) ^ s2.Encode(0)
+	}
+	s2Linear := NewSBox(target)
+
+	out := []AffineEquivalence{}
+	for q := 0; q < n; q++ {
+		c := s1.Encode(uint16(q))
+
+		translated := make([]uint16, n)
+		for x := range translated {
+			translated[x] = s1.Encode(uint16(x)^uint16(q)) ^ c
+		}
+
+		// s2(x) = B'(s1(A'(x)+q) + s1(q)) + s2(0), for linear A' and B'.
+		tooMany := !newLinearSearch(NewSBox(translated), s2Linear).search(func(a, b []int32) bool {
+			if len(out) == limit {
+				return false
+			}
+
+			out = append(out, AffineEquivalence{
+				affineMapOf(width, func(x uint16) uint16 { return uint16(a[x]) ^ uint16(q) }),
+				affineMapOf(width, func(y uint16) uint16 { return uint16(b[y]) ^ uint16(b[c]) ^ s2.Encode(0) }),
+			})
+			return true
+		})
+
+		if tooMany {
+			return nil, ErrTooManyEquivalences
+		}
+	}
+
+	return out, nil
+}
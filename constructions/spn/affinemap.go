@@ -0,0 +1,172 @@
+package spn
+
+import (
+	"io"
+
+	"github.com/OpenWhiteBox/primitives/matrix"
+
+	"github.com/OpenWhiteBox/Generic/internal/gf2"
+	"github.com/OpenWhiteBox/Generic/internal/random"
+)
+
+// AffineMap is an invertible affine map on width-bit values, x -> Linear*x + Constant, where row i of Linear gives bit i
+// of the output. An S-box layer can be composed with an AffineMap on each S-box's output, and the affine layer after it
+// with their inverses, without changing the cipher. The same goes for the S-boxes' inputs and the affine layer before.
+type AffineMap struct {
+	Linear   matrix.Matrix
+	Constant uint16
+}
+
+// IdentityMap returns the identity map on width-bit values.
+func IdentityMap(width int) AffineMap {
+	return affineMapOf(width, func(x uint16) uint16 { return x })
+}
+
+// GenerateAffineMap generates a random invertible affine map on width-bit values using the random source random. It
+// panics if the random source fails.
+func GenerateAffineMap(rand io.Reader, width int) AffineMap {
+	buf := make([]byte, 2*(width+1))
+
+	for {
+		random.ReadFull(rand, buf)
+
+		am := affineMapOf(width, func(x uint16) (out uint16) {
+			for i := 0; i <= width; i++ {
+				if i == 0 || x>>uint(i-1)&1 == 1 {
+					out ^= uint16(buf[2*i]) | uint16(buf[2*i+1])<<8
+				}
+			}
+
+			return out & uint16(1<<uint(width)-1)
+		})
+
+		if am.invertible() {
+			return am
+		}
+	}
+}
+
+// affineMapOf returns the affine map on width-bit values which agrees with f, assuming that f is affine.
+func affineMapOf(width int, f func(x uint16) uint16) AffineMap {
+	constant := f(0)
+
+	linear := make(matrix.Matrix, width)
+	for i := range linear {
+		linear[i] = matrix.NewRow(width)
+	}
+
+	for col := 0; col < width; col++ {
+		image := f(1<<uint(col)) ^ constant
+
+		for row := 0; row < width; row++ {
+			linear[row][col/8] |= byte(image>>uint(row)&1) << uint(col%8)
+		}
+	}
+
+	return AffineMap{linear, constant}
+}
+
+// Width returns the number of bits the map acts on.
+func (am AffineMap) Width() int { return len(am.Linear) }
+
+// Apply returns the image of x.
+func (am AffineMap) Apply(x uint16) uint16 {
+	in := matrix.NewRow(am.Width())
+	gf2.SetChunk(in, 0, am.Width(), x)
+
+	return gf2.GetChunk(am.Linear.Mul(in), 0, am.Width()) ^ am.Constant
+}
+
+// invertible returns true if the map is a bijection.
+func (am AffineMap) invertible() bool {
+	seen := make([]bool, 1<<uint(am.Width()))
+
+	for x := range seen {
+		y := am.Apply(uint16(x))
+		if seen[y] {
+			return false
+		}
+		seen[y] = true
+	}
+
+	return true
+}
+
+// Inverse returns the map which undoes this one. It panics if the map isn't invertible.
+func (am AffineMap) Inverse() AffineMap {
+	if !am.invertible() {
+		panic("Affine map must be invertible!")
+	}
+
+	inverse := make([]uint16, 1<<uint(am.Width()))
+	for x := range inverse {
+		inverse[am.Apply(uint16(x))] = uint16(x)
+	}
+
+	return affineMapOf(am.Width(), func(y uint16) uint16 { return inverse[y] })
+}
+
+// Compose returns the map which applies inner and then am.
+func (am AffineMap) Compose(inner AffineMap) AffineMap {
+	return affineMapOf(am.Width(), func(x uint16) uint16 { return am.Apply(inner.Apply(x)) })
+}
+
+// Equal returns true if the two maps are the same.
+func (am AffineMap) Equal(other AffineMap) bool {
+	if am.Width() != other.Width() {
+		return false
+	}
+
+	for x := 0; x <= am.Width(); x++ {
+		in := uint16(0)
+		if x > 0 {
+			in = 1 << uint(x-1)
+		}
+
+		if am.Apply(in) != other.Apply(in) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ChunkLayer returns the affine layer which applies maps[i] to the ith chunk of its input. It panics if a map isn't
+// invertible.
+func ChunkLayer(maps []AffineMap) AffineLayer {
+	forwards, backwards := make([]AffineMap, len(maps)), make([]AffineMap, len(maps))
+	for i, am := range maps {
+		forwards[i], backwards[i] = am, am.Inverse()
+	}
+
+	linear, constant := blockDiagonal(forwards)
+	inverse, _ := blockDiagonal(backwards)
+
+	return AffineLayer{linear, inverse, constant}
+}
+
+// blockDiagonal returns the linear and constant parts of the affine map on blocks which applies maps[i] to the ith
+// chunk.
+func blockDiagonal(maps []AffineMap) (matrix.Matrix, []byte) {
+	bits := 0
+	for _, am := range maps {
+		bits += am.Width()
+	}
+
+	linear, constant := make(matrix.Matrix, bits), make([]byte, bits/8)
+
+	offset := 0
+	for _, am := range maps {
+		width := am.Width()
+
+		for row := 0; row < width; row++ {
+			linear[offset+row] = matrix.NewRow(bits)
+			gf2.SetChunk(linear[offset+row], offset, width, gf2.GetChunk(am.Linear[row], 0, width))
+		}
+		gf2.SetChunk(constant, offset, width, am.Constant)
+
+		offset += width
+	}
+
+	return linear, constant
+}
@@ -0,0 +1,224 @@
+package spn
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/OpenWhiteBox/primitives/matrix"
+
+	"github.com/OpenWhiteBox/Generic/internal/gf2"
+)
+
+// composeAffine returns the affine layer which applies inner and then outer.
+func composeAffine(outer, inner AffineLayer) AffineLayer {
+	constant := outer.Forwards.Mul(matrix.Row(inner.Constant))
+	for i := range constant {
+		constant[i] ^= outer.Constant[i]
+	}
+
+	return AffineLayer{outer.Forwards.Compose(inner.Forwards), inner.Backwards.Compose(outer.Backwards), constant}
+}
+
+// composeSBoxes returns the S-box layer which applies inner and then outer.
+func composeSBoxes(outer, inner SBoxLayer) SBoxLayer {
+	out := make(SBoxLayer, len(inner))
+	for pos := range inner {
+		encKey := make([]uint16, len(inner[pos].EncKey))
+		for x, y := range inner[pos].EncKey {
+			encKey[x] = outer[pos].EncKey[y]
+		}
+
+		out[pos] = NewSBox(encKey)
+	}
+
+	return out
+}
+
+// merge composes adjacent layers of the same type, so that S-box and affine layers alternate.
+func merge(constr Construction) Construction {
+	out := Construction{}
+
+	for _, layer := range constr {
+		if len(out) == 0 {
+			out = append(out, layer)
+			continue
+		}
+
+		switch prev := out[len(out)-1].(type) {
+		case AffineLayer:
+			if al, ok := layer.(AffineLayer); ok {
+				out[len(out)-1] = composeAffine(al, prev)
+				continue
+			}
+		case SBoxLayer:
+			if sl, ok := layer.(SBoxLayer); ok {
+				out[len(out)-1] = composeSBoxes(sl, prev)
+				continue
+			}
+		}
+
+		out = append(out, layer)
+	}
+
+	return out
+}
+
+// sboxOutputs returns the affine map which takes the S-box's output to its canonical form. The canonical S-box sends 0
+// to 0 and the ith input, in increasing order, whose output isn't in the affine span of the ones before it to the ith
+// unit vector.
+func sboxOutputs(s SBox) AffineMap {
+	width := s.Width()
+	s0 := s.Encode(0)
+
+	span := map[uint16]bool{0: true}
+	columns := make([]uint16, 0, width)
+
+	for x := 1; len(columns) < width; x++ {
+		d := s.Encode(uint16(x)) ^ s0
+		if span[d] {
+			continue
+		}
+
+		columns = append(columns, d)
+		for y := range span {
+			span[y^d] = true
+		}
+	}
+
+	basis := affineMapOf(width, func(x uint16) (out uint16) {
+		for i, col := range columns {
+			if x>>uint(i)&1 == 1 {
+				out ^= col
+			}
+		}
+
+		return out
+	}).Inverse()
+
+	return affineMapOf(width, func(y uint16) uint16 { return basis.Apply(y ^ s0) })
+}
+
+// chunkPermutation returns the affine layer which moves the ith width-bit chunk of its input to chunk perm[i].
+func chunkPermutation(perm []int, width int) AffineLayer {
+	bits := len(perm) * width
+	forwards, backwards := make(matrix.Matrix, bits), make(matrix.Matrix, bits)
+
+	for i, j := range perm {
+		for b := 0; b < width; b++ {
+			forwards[j*width+b], backwards[i*width+b] = matrix.NewRow(bits), matrix.NewRow(bits)
+			gf2.SetChunk(forwards[j*width+b], i*width+b, 1, 1)
+			gf2.SetChunk(backwards[i*width+b], j*width+b, 1, 1)
+		}
+	}
+
+	return AffineLayer{forwards, backwards, make([]byte, bits/8)}
+}
+
+// canonicalAffine returns the canonical form of al up to an invertible affine map on each width-bit chunk of its output
+// and, if sorted is true, a permutation of the chunks. The rows for each chunk are put in reduced row echelon form, the
+// constant is zero, and the chunks are sorted by their rows. It also returns the permutation and the maps which take al
+// to its canonical form: chunk i of al's output is sent through maps[i] to chunk perm[i].
+func canonicalAffine(al AffineLayer, width int, sorted bool) (out AffineLayer, perm []int, maps []AffineMap) {
+	chunks := len(al.Forwards) / width
+
+	blocks, keys := make([]matrix.Matrix, chunks), make([][]byte, chunks)
+	order := make([]int, chunks)
+	for i := range blocks {
+		blocks[i] = gf2.ReducedRows(al.Forwards[i*width : (i+1)*width])
+		for _, row := range blocks[i] {
+			keys[i] = append(keys[i], row...)
+		}
+		order[i] = i
+	}
+
+	if sorted {
+		sort.Slice(order, func(a, b int) bool { return bytes.Compare(keys[order[a]], keys[order[b]]) < 0 })
+	}
+
+	linear := matrix.Matrix{}
+	perm = make([]int, chunks)
+	for j, i := range order {
+		linear = append(linear, blocks[i]...)
+		perm[i] = j
+	}
+	out = NewAffineLayer(linear, make([]byte, len(al.Constant)))
+
+	// out after al's inverse applies maps[i] to chunk i and moves it to chunk perm[i].
+	change := composeAffine(out, al.Inverse())
+	maps = make([]AffineMap, chunks)
+	for i := range maps {
+		maps[i] = affineMapOf(width, func(x uint16) uint16 {
+			in, res := make([]byte, len(al.Constant)), make([]byte, len(al.Constant))
+			gf2.SetChunk(in, i*width, width, x)
+			change.Encode(res, in)
+
+			return gf2.GetChunk(res, perm[i]*width, width)
+		})
+	}
+
+	return out, perm, maps
+}
+
+// Canonical returns the canonical form of the construction: the same function, with S-box and affine layers alternating,
+// which is the same for every construction that differs from this one by invertible affine maps on each S-box's input or
+// output, or by the order of the S-boxes in a layer between two affine layers, with the other layers changed to make up
+// for it.
+//
+// Adjacent layers of the same type are composed, and then each layer except the last is normalized in the order they're
+// applied. An S-box followed by an affine layer sends 0 to 0, and the ith input in increasing order whose output isn't in
+// the affine span of the ones before it to the ith unit vector. An affine layer followed by an S-box layer has zero
+// constant and the rows for each S-box in reduced row echelon form. Those S-boxes are sorted by their rows, unless
+// they're the last layer. The changes are pushed into the following layers.
+//
+// It returns the same errors as Normalize.
+func (constr Construction) Canonical() (Construction, error) {
+	normalized, err := constr.Normalize()
+	if err != nil {
+		return nil, err
+	}
+	out := merge(normalized)
+
+	for k := 0; k < len(out)-1; k++ {
+		switch layer := out[k].(type) {
+		case SBoxLayer:
+			maps, next := make([]AffineMap, len(layer)), make(SBoxLayer, len(layer))
+			for pos, sbox := range layer {
+				maps[pos] = sboxOutputs(sbox)
+
+				encKey := make([]uint16, len(sbox.EncKey))
+				for x, y := range sbox.EncKey {
+					encKey[x] = maps[pos].Apply(y)
+				}
+				next[pos] = NewSBox(encKey)
+			}
+
+			out[k] = next
+			out[k+1] = composeAffine(out[k+1].(AffineLayer), ChunkLayer(maps).Inverse())
+
+		case AffineLayer:
+			sl := out[k+1].(SBoxLayer)
+			width := sl[0].Width()
+
+			al, perm, maps := canonicalAffine(layer, width, k+2 < len(out))
+			out[k] = al
+
+			next := make(SBoxLayer, len(sl))
+			for i, sbox := range sl {
+				inverse := maps[i].Inverse()
+
+				encKey := make([]uint16, len(sbox.EncKey))
+				for x := range encKey {
+					encKey[x] = sbox.Encode(inverse.Apply(uint16(x)))
+				}
+				next[perm[i]] = NewSBox(encKey)
+			}
+			out[k+1] = next
+
+			if k+2 < len(out) {
+				out[k+2] = composeAffine(out[k+2].(AffineLayer), chunkPermutation(perm, width).Inverse())
+			}
+		}
+	}
+
+	return out, nil
+}
@@ -0,0 +1,175 @@
+package spn
+
+import (
+	"bytes"
+
+	"github.com/OpenWhiteBox/Generic/internal/gf2"
+)
+
+// exhaustiveBlockSize is the largest block size, in bytes, that Equivalent checks on every input.
+const exhaustiveBlockSize = 2
+
+// equalLayers returns true if two S-box or affine layers are the same.
+func equalLayers(a, b Layer) bool {
+	switch a := a.(type) {
+	case SBoxLayer:
+		b, ok := b.(SBoxLayer)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+
+		for pos := range a {
+			if len(a[pos].EncKey) != len(b[pos].EncKey) {
+				return false
+			}
+
+			for x := range a[pos].EncKey {
+				if a[pos].EncKey[x] != b[pos].EncKey[x] {
+					return false
+				}
+			}
+		}
+
+		return true
+
+	case AffineLayer:
+		b, ok := b.(AffineLayer)
+		if !ok || !bytes.Equal(a.Constant, b.Constant) {
+			return false
+		}
+
+		for i := range a.Forwards {
+			if !bytes.Equal(a.Forwards[i], b.Forwards[i]) {
+				return false
+			}
+		}
+
+		return true
+
+	default:
+		return false
+	}
+}
+
+// differenceInputs returns the inputs to layer a, which is assumed to differ from layer b, that might show the
+// difference: every input to a differing S-box with the others zero, or zero and every unit vector.
+func differenceInputs(a, b Layer) (out [][]byte) {
+	switch a := a.(type) {
+	case SBoxLayer:
+		b, ok := b.(SBoxLayer)
+		if !ok || len(a) != len(b) {
+			return nil
+		}
+
+		width := a[0].Width()
+		for pos := range a {
+			for x := range a[pos].EncKey {
+				if x < len(b[pos].EncKey) && a[pos].EncKey[x] != b[pos].EncKey[x] {
+					in := make([]byte, a.BlockSize())
+					gf2.SetChunk(in, pos*width, width, uint16(x))
+					out = append(out, in)
+				}
+			}
+		}
+
+		return out
+
+	default:
+		return unitInputs(a.BlockSize())
+	}
+}
+
+// unitInputs returns zero and every unit vector on blocks of blockSize bytes.
+func unitInputs(blockSize int) [][]byte {
+	out := [][]byte{make([]byte, blockSize)}
+
+	for i := 0; i < 8*blockSize; i++ {
+		in := make([]byte, blockSize)
+		gf2.SetChunk(in, i, 1, 1)
+		out = append(out, in)
+	}
+
+	return out
+}
+
+// disagree returns true if the constructions encrypt in to different blocks.
+func disagree(constr1, constr2 Construction, in []byte) bool {
+	out1, out2 := make([]byte, len(in)), make([]byte, len(in))
+	constr1.Encrypt(out1, in)
+	constr2.Encrypt(out2, in)
+
+	return !bytes.Equal(out1, out2)
+}
+
+// Equivalent decides whether two constructions compute the same function, without sampling. If they don't, it returns
+// an input they encrypt differently, when it finds one.
+//
+// Blocks of up to 16 bits are checked on every input. Larger constructions are equivalent if their canonical forms are
+// the same. Otherwise, it looks for an input where they differ, starting with the inputs to each layer where the
+// canonical forms differ, run back through the layers before it, and then zero and every unit vector. Canonical forms
+// are only unique when no layer is degenerate, so constructions with different canonical forms, even of the same
+// structure, can still compute the same function: for example, if an S-box layer is the identity or an S-box is affine.
+// If none of the inputs show a difference between them, it returns ErrUndecided rather than guessing.
+//
+// It returns ErrBlockSize if the constructions have different block sizes, or any error Canonical returns.
+func Equivalent(constr1, constr2 Construction) (bool, []byte, error) {
+	blockSize := constr1.BlockSize()
+	if constr2.BlockSize() != blockSize {
+		return false, nil, ErrBlockSize
+	}
+
+	if blockSize <= exhaustiveBlockSize {
+		in := make([]byte, blockSize)
+
+		for x := 0; x < 1<<uint(8*blockSize); x++ {
+			gf2.SetChunk(in, 0, 8*blockSize, uint16(x))
+
+			if disagree(constr1, constr2, in) {
+				return false, in, nil
+			}
+		}
+
+		return true, nil, nil
+	}
+
+	canonical1, err := constr1.Canonical()
+	if err != nil {
+		return false, nil, err
+	}
+	canonical2, err := constr2.Canonical()
+	if err != nil {
+		return false, nil, err
+	}
+
+	differ := []int{}
+	for k := 0; k < len(canonical1) && k < len(canonical2); k++ {
+		if !equalLayers(canonical1[k], canonical2[k]) {
+			differ = append(differ, k)
+		}
+	}
+
+	if canonical1.Structure() == canonical2.Structure() && len(differ) == 0 {
+		return true, nil, nil
+	}
+
+	candidates := [][]byte{}
+	for _, k := range differ {
+		// Run the inputs to layer k back through the layers before it of both constructions, since the differences
+		// in those layers might hide the difference in layer k.
+		for _, in := range differenceInputs(canonical1[k], canonical2[k]) {
+			in1, in2 := make([]byte, blockSize), make([]byte, blockSize)
+			canonical1[:k].Decrypt(in1, in)
+			canonical2[:k].Decrypt(in2, in)
+			candidates = append(candidates, in1, in2)
+		}
+	}
+	candidates = append(candidates, unitInputs(blockSize)...)
+
+	for _, in := range candidates {
+		if disagree(constr1, constr2, in) {
+			return false, in, nil
+		}
+	}
+
+	return false, nil, ErrUndecided
+}
@@ -0,0 +1,64 @@
+package spn
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrBadMagic is returned when parsing something that isn't a serialized construction.
+	ErrBadMagic = errors.New("spn: wrong magic number")
+	// ErrUnknownVersion is returned when parsing a serialization format newer than this package.
+	ErrUnknownVersion = errors.New("spn: unknown serialization version")
+	// ErrInvalidHeader is returned when the header has an invalid structure or dimensions.
+	ErrInvalidHeader = errors.New("spn: invalid structure or dimensions in header")
+	// ErrTruncated is returned when the input ends before the construction does.
+	ErrTruncated = errors.New("spn: serialized construction is truncated")
+	// ErrTrailingData is returned when the input continues after the construction ends.
+	ErrTrailingData = errors.New("spn: trailing data after serialized construction")
+	// ErrChecksum is returned when the checksum doesn't match the rest of the input.
+	ErrChecksum = errors.New("spn: checksum mismatch")
+	// ErrEmpty is returned by Serialize when the construction has no layers, which the header can't describe.
+	ErrEmpty = errors.New("spn: construction has no layers to serialize")
+	// ErrTooLarge is returned by Serialize when the construction has too many layers or too large a block for the header.
+	ErrTooLarge = errors.New("spn: construction is too large to serialize")
+	// ErrWrongStructure is returned by Parse when the construction doesn't have the expected structure.
+	ErrWrongStructure = errors.New("spn: construction has the wrong structure")
+	// ErrNotBijective is returned when an S-box isn't a permutation.
+	ErrNotBijective = errors.New("spn: S-box is not bijective")
+	// ErrSingular is returned when the linear part of an affine layer isn't invertible.
+	ErrSingular = errors.New("spn: linear part of affine layer is singular")
+	// ErrUnsupportedLayer is returned when a layer can't be converted into S-box and affine layers.
+	ErrUnsupportedLayer = errors.New("spn: layer is neither an S-box layer nor an affine layer")
+	// ErrBlockSize is returned when the layers of a construction have different block sizes.
+	ErrBlockSize = errors.New("spn: layers have different block sizes")
+	// ErrSBoxSize is returned when the S-boxes of a construction have different widths.
+	ErrSBoxSize = errors.New("spn: S-boxes have different widths")
+	// ErrUndecided is returned by Equivalent when two constructions have different canonical forms, so it can't prove
+	// that they compute the same function, and it can't find an input they disagree on either.
+	ErrUndecided = errors.New("spn: couldn't decide whether constructions are equivalent")
+	// ErrNotRelated is returned by Relate when a layer of one construction isn't the same layer of the other up to affine
+	// maps on each S-box.
+	ErrNotRelated = errors.New("spn: layers aren't related by affine maps on each S-box")
+	// ErrTooManyEquivalences is returned by AffineEquivalences when the S-boxes are related by more pairs of affine maps
+	// than it was asked for.
+	ErrTooManyEquivalences = errors.New("spn: too many affine equivalences between S-boxes")
+)
+
+// LayerError records which layer of a construction, and which S-box in that layer, caused an error. Layers are counted
+// in the order they're applied to the input. SBox is -1 if the error isn't about a specific S-box.
+type LayerError struct {
+	Layer, SBox int
+	Err         error
+}
+
+func (e *LayerError) Error() string {
+	if e.SBox >= 0 {
+		return fmt.Sprintf("%v (layer %v, S-box %v)", e.Err, e.Layer, e.SBox)
+	}
+
+	return fmt.Sprintf("%v (layer %v)", e.Err, e.Layer)
+}
+
+// Unwrap returns the underlying error, so that errors.Is(err, ErrSingular) and the like work.
+func (e *LayerError) Unwrap() error { return e.Err }
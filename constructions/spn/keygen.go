@@ -1,65 +1,135 @@
 package spn
 
 import (
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha256"
 	"io"
 
-	"github.com/OpenWhiteBox/primitives/encoding"
 	"github.com/OpenWhiteBox/primitives/matrix"
+
+	"github.com/OpenWhiteBox/Generic/internal/random"
 )
 
-func newAffineLayer(rand io.Reader) encoding.BlockAffine {
-	c := [16]byte{}
-	rand.Read(c[:])
+// Params are the dimensions of an SPN.
+type Params struct {
+	BlockSize int // The block size, in bytes.
+	SBoxSize  int // The width of each S-box, in bits.
+}
+
+// DefaultParams are the dimensions of the SPNs generated by NewSPN: 128-bit blocks and 8-bit S-boxes.
+var DefaultParams = Params{BlockSize: 16, SBoxSize: 8}
 
-	return encoding.NewBlockAffine(matrix.GenerateRandom(rand, 128), c)
+// Valid returns true if the S-boxes are between 1 and 16 bits wide and evenly divide a block of positive size. For
+// example, 6-bit S-boxes need a block size that's a multiple of 3 bytes, like Params{BlockSize: 12, SBoxSize: 6}.
+// cryptanalysis/spn only attacks 128-bit blocks with 4- or 8-bit S-boxes.
+func (params Params) Valid() bool {
+	return params.BlockSize > 0 && params.SBoxSize > 0 && params.SBoxSize <= 16 &&
+		(8*params.BlockSize)%params.SBoxSize == 0
 }
 
-func newSBoxLayer(rand io.Reader) encoding.ConcatenatedBlock {
-	sbox := encoding.ConcatenatedBlock{}
-	for pos := 0; pos < 16; pos++ {
-		sbox[pos] = encoding.GenerateSBox(rand)
+// SBoxes returns the number of S-boxes in each S-box layer.
+func (params Params) SBoxes() int { return 8 * params.BlockSize / params.SBoxSize }
+
+// generateMatrix reads n rows of n bits at a time from the random source until they form an invertible matrix.
+func generateMatrix(rand io.Reader, n int) matrix.Matrix {
+	for {
+		m := make(matrix.Matrix, n)
+		for i := range m {
+			m[i] = matrix.NewRow(n)
+			random.ReadFull(rand, m[i])
+		}
+
+		if _, ok := m.Invert(); ok {
+			return m
+		}
+	}
+}
+
+func newAffineLayer(rand io.Reader, params Params) AffineLayer {
+	linear := generateMatrix(rand, 8*params.BlockSize)
+
+	c := make([]byte, params.BlockSize)
+	random.ReadFull(rand, c)
+
+	return NewAffineLayer(linear, c)
+}
+
+func newSBoxLayer(rand io.Reader, params Params) SBoxLayer {
+	sbox := make(SBoxLayer, params.SBoxes())
+	for pos := range sbox {
+		sbox[pos] = GenerateSBox(rand, params.SBoxSize)
 	}
 
 	return sbox
 }
 
 // NewSPN generates a random SPN instance using the random source random (for example, crypto/rand.Reader), with the
-// specified structure.
+// specified structure, 128-bit blocks, and 8-bit S-boxes. It panics if the random source fails.
 func NewSPN(rand io.Reader, structure Structure) Construction {
-	switch structure {
-	case AS:
-		return Construction(encoding.ComposedBlocks{
-			newSBoxLayer(rand), newAffineLayer(rand),
-		})
-	case SA:
-		return Construction(encoding.ComposedBlocks{
-			newAffineLayer(rand), newSBoxLayer(rand),
-		})
-	case ASA:
-		return Construction(encoding.ComposedBlocks{
-			newAffineLayer(rand), newSBoxLayer(rand), newAffineLayer(rand),
-		})
-	case SAS:
-		return Construction(encoding.ComposedBlocks{
-			newSBoxLayer(rand), newAffineLayer(rand), newSBoxLayer(rand),
-		})
-	case ASAS:
-		return Construction(encoding.ComposedBlocks{
-			newSBoxLayer(rand), newAffineLayer(rand), newSBoxLayer(rand), newAffineLayer(rand),
-		})
-	case SASA:
-		return Construction(encoding.ComposedBlocks{
-			newAffineLayer(rand), newSBoxLayer(rand), newAffineLayer(rand), newSBoxLayer(rand),
-		})
-	case ASASA:
-		return Construction(encoding.ComposedBlocks{
-			newAffineLayer(rand), newSBoxLayer(rand), newAffineLayer(rand), newSBoxLayer(rand), newAffineLayer(rand),
-		})
-	case SASAS:
-		return Construction(encoding.ComposedBlocks{
-			newSBoxLayer(rand), newAffineLayer(rand), newSBoxLayer(rand), newAffineLayer(rand), newSBoxLayer(rand),
-		})
+	return NewSPNWithParams(rand, structure, DefaultParams)
+}
+
+// NewSPNWithParams generates a random SPN instance using the random source random, with the specified structure and
+// dimensions. It panics if the dimensions are invalid or the random source fails.
+//
+// Layers are generated in the order they're applied. An affine layer is a matrix, read a row at a time and retried until
+// it's invertible, followed by a constant. An S-box layer is a Fisher-Yates shuffle for each S-box; see GenerateSBox.
+func NewSPNWithParams(rand io.Reader, structure Structure, params Params) (constr Construction) {
+	if !params.Valid() {
+		panic("Invalid SPN dimensions!")
+	}
+
+	for _, layer := range structure.Layers() {
+		switch layer {
+		case Substitution:
+			constr = append(constr, newSBoxLayer(rand, params))
+		case Affine:
+			constr = append(constr, newAffineLayer(rand, params))
+		}
+	}
+
+	return
+}
+
+// NewSPNFromKey deterministically derives an SPN instance from a 16-, 24-, or 32-byte key, with the specified structure,
+// 128-bit blocks, and 8-bit S-boxes. The same key always gives the same SPN, so a key can be shared in place of the
+// serialized SPN.
+//
+// The SPN is generated by NewSPNWithParams from the AES-CTR keystream, with an all-zero IV, under a subkey of the same
+// length: the start of HMAC-SHA256 under key of the structure and dimensions, encoded as in the header of a serialized
+// construction. SPNs derived from the same key with different structures or dimensions don't share layers.
+func NewSPNFromKey(key []byte, structure Structure) (Construction, error) {
+	return NewSPNFromKeyWithParams(key, structure, DefaultParams)
+}
+
+// NewSPNFromKeyWithParams deterministically derives an SPN instance from a key, with the specified structure and
+// dimensions. See NewSPNFromKey. It panics if the dimensions are invalid.
+func NewSPNFromKeyWithParams(key []byte, structure Structure, params Params) (Construction, error) {
+	switch len(key) {
+	case 16, 24, 32:
 	default:
-		panic("Unknown SPN structure!")
+		return nil, aes.KeySizeError(len(key))
 	}
+
+	stream, err := random.KeyStream(deriveKey(key, structure, params))
+	if err != nil {
+		return nil, err
+	}
+
+	return NewSPNWithParams(stream, structure, params), nil
+}
+
+// deriveKey returns the subkey NewSPNFromKeyWithParams generates an SPN with the given structure and dimensions from.
+func deriveKey(key []byte, structure Structure, params Params) []byte {
+	info := []byte(Magic)
+	info = append(info, byte(len(structure)))
+	info = append(info, structure...)
+	info = append(info, byte(params.BlockSize>>8), byte(params.BlockSize))
+	info = append(info, byte(params.SBoxSize))
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(info)
+
+	return mac.Sum(nil)[:len(key)]
 }
@@ -0,0 +1,121 @@
+package spn
+
+import (
+	"github.com/OpenWhiteBox/primitives/encoding"
+	"github.com/OpenWhiteBox/primitives/matrix"
+)
+
+// Layer is one layer of an SPN. It is a bijection on blocks of BlockSize bytes. Encode and Decode write the image of
+// src to dst, and dst and src may point at the same memory.
+type Layer interface {
+	BlockSize() int
+	Encode(dst, src []byte)
+	Decode(dst, src []byte)
+}
+
+// AffineLayer treats its input as an element of GF(2)^n and applies an invertible affine transformation to it.
+type AffineLayer struct {
+	Forwards, Backwards matrix.Matrix
+	Constant            []byte
+}
+
+// NewAffineLayer returns the affine layer x -> linear*x + constant. It panics if linear isn't invertible.
+func NewAffineLayer(linear matrix.Matrix, constant []byte) AffineLayer {
+	inv, ok := linear.Invert()
+	if !ok {
+		panic("Linear part of an affine layer must be invertible!")
+	}
+
+	return AffineLayer{linear, inv, constant}
+}
+
+// BlockSize returns the number of bytes the layer operates on.
+func (al AffineLayer) BlockSize() int { return len(al.Constant) }
+
+func (al AffineLayer) Encode(dst, src []byte) {
+	out := al.Forwards.Mul(matrix.Row(src))
+	encoding.XOR(dst, out, al.Constant)
+}
+
+func (al AffineLayer) Decode(dst, src []byte) {
+	temp := make([]byte, len(al.Constant))
+	encoding.XOR(temp, src, al.Constant)
+	copy(dst, al.Backwards.Mul(matrix.Row(temp)))
+}
+
+// Block wraps a 128-bit encoding.Block as a Layer.
+type Block struct{ encoding.Block }
+
+// BlockSize returns the number of bytes the layer operates on, which is always 16.
+func (b Block) BlockSize() int { return 16 }
+
+func (b Block) Encode(dst, src []byte) {
+	temp := [16]byte{}
+	copy(temp[:], src)
+
+	temp = b.Block.Encode(temp)
+
+	copy(dst, temp[:])
+}
+
+func (b Block) Decode(dst, src []byte) {
+	temp := [16]byte{}
+	copy(temp[:], src)
+
+	temp = b.Block.Decode(temp)
+
+	copy(dst, temp[:])
+}
+
+// FromBlock converts a 128-bit encoding.Block into a Layer. S-box layers and affine layers are converted into an
+// SBoxLayer and an AffineLayer, and anything else is wrapped in a Block.
+func FromBlock(block encoding.Block) Layer {
+	switch block := block.(type) {
+	case encoding.ConcatenatedBlock:
+		sl := make(SBoxLayer, 16)
+		for pos, sbox := range block {
+			encKey := make([]uint16, 256)
+			for x := range encKey {
+				encKey[x] = uint16(sbox.Encode(byte(x)))
+			}
+
+			sl[pos] = NewSBox(encKey)
+		}
+
+		return sl
+
+	case encoding.BlockAffine:
+		constant := make([]byte, 16)
+		copy(constant, block.BlockAdditive[:])
+
+		return AffineLayer{block.BlockLinear.Forwards, block.BlockLinear.Backwards, constant}
+
+	default:
+		return Block{block}
+	}
+}
+
+// layerBlock wraps a 128-bit Layer as an encoding.Block.
+type layerBlock struct{ Layer }
+
+func (lb layerBlock) Encode(in [16]byte) (out [16]byte) {
+	lb.Layer.Encode(out[:], in[:])
+	return
+}
+
+func (lb layerBlock) Decode(in [16]byte) (out [16]byte) {
+	lb.Layer.Decode(out[:], in[:])
+	return
+}
+
+// ToBlock converts a Layer with 128-bit blocks into an encoding.Block. It panics if the layer has a different block
+// size.
+func ToBlock(layer Layer) encoding.Block {
+	if block, ok := layer.(Block); ok {
+		return block.Block
+	} else if layer.BlockSize() != 16 {
+		panic("Only 128-bit layers can be converted into an encoding.Block!")
+	}
+
+	return layerBlock{layer}
+}
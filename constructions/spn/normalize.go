@@ -0,0 +1,127 @@
+package spn
+
+import (
+	"github.com/OpenWhiteBox/primitives/encoding"
+	"github.com/OpenWhiteBox/primitives/matrix"
+)
+
+// Inverse returns the S-box layer which undoes this one.
+func (sl SBoxLayer) Inverse() SBoxLayer {
+	out := make(SBoxLayer, len(sl))
+	for pos, sbox := range sl {
+		out[pos] = SBox{sbox.DecKey, sbox.EncKey}
+	}
+
+	return out
+}
+
+// Inverse returns the affine layer which undoes this one.
+func (al AffineLayer) Inverse() AffineLayer {
+	constant := al.Backwards.Mul(matrix.Row(al.Constant))
+	return AffineLayer{al.Backwards, al.Forwards, constant}
+}
+
+// normalizeBlock converts a 128-bit encoding.Block into a sequence of S-box and affine layers, in the order they're
+// applied to the input.
+func normalizeBlock(block encoding.Block) ([]Layer, error) {
+	switch block := block.(type) {
+	case encoding.ConcatenatedBlock, encoding.BlockAffine:
+		return []Layer{FromBlock(block)}, nil
+
+	case encoding.BlockLinear:
+		return []Layer{AffineLayer{block.Forwards, block.Backwards, make([]byte, 16)}}, nil
+
+	case encoding.BlockAdditive:
+		constant := make([]byte, 16)
+		copy(constant, block[:])
+
+		return []Layer{AffineLayer{matrix.GenerateIdentity(128), matrix.GenerateIdentity(128), constant}}, nil
+
+	case encoding.ComposedBlocks:
+		out := []Layer{}
+		for _, sub := range block {
+			layers, err := normalizeBlock(sub)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, layers...)
+		}
+
+		return out, nil
+
+	case encoding.InverseBlock:
+		layers, err := normalizeBlock(block.Block)
+		if err != nil {
+			return nil, err
+		}
+
+		out := make([]Layer, len(layers))
+		for i, layer := range layers {
+			switch layer := layer.(type) {
+			case SBoxLayer:
+				out[len(layers)-1-i] = layer.Inverse()
+			case AffineLayer:
+				out[len(layers)-1-i] = layer.Inverse()
+			}
+		}
+
+		return out, nil
+
+	case layerBlock:
+		return normalizeLayer(block.Layer)
+
+	default:
+		// A block can only be checked against an S-box or affine layer on some of its inputs, which doesn't prove that it
+		// is one, so unknown blocks aren't converted.
+		return nil, ErrUnsupportedLayer
+	}
+}
+
+// normalizeLayer converts any layer into a sequence of S-box and affine layers.
+func normalizeLayer(layer Layer) ([]Layer, error) {
+	switch layer := layer.(type) {
+	case SBoxLayer, AffineLayer:
+		return []Layer{layer}, nil
+	case Block:
+		return normalizeBlock(layer.Block)
+	default:
+		return nil, ErrUnsupportedLayer
+	}
+}
+
+// Normalize returns a construction computing the same function which only contains SBoxLayers and AffineLayers,
+// flattening composed and inverted layers and recognizing wrapped encoding.Blocks. Only S-box, affine, linear, and
+// additive blocks, and compositions and inverses of them, are recognized; other blocks can't be told apart from those
+// without querying every input. It returns a *LayerError wrapping ErrUnsupportedLayer if a layer can't be converted,
+// ErrBlockSize if the layers have different block sizes, or ErrSBoxSize if the S-boxes have different widths.
+func (constr Construction) Normalize() (Construction, error) {
+	out := Construction{}
+	width := 0
+
+	for i, layer := range constr {
+		layers, err := normalizeLayer(layer)
+		if err != nil {
+			return nil, &LayerError{i, -1, err}
+		}
+
+		for _, layer := range layers {
+			if layer.BlockSize() != constr.BlockSize() {
+				return nil, &LayerError{i, -1, ErrBlockSize}
+			}
+
+			if sl, ok := layer.(SBoxLayer); ok {
+				for pos, sbox := range sl {
+					if width == 0 {
+						width = sbox.Width()
+					} else if sbox.Width() != width {
+						return nil, &LayerError{i, pos, ErrSBoxSize}
+					}
+				}
+			}
+		}
+
+		out = append(out, layers...)
+	}
+
+	return out, nil
+}
@@ -1,102 +1,266 @@
 package spn
 
 import (
-	"github.com/OpenWhiteBox/primitives/encoding"
+	"hash/crc32"
+
 	"github.com/OpenWhiteBox/primitives/matrix"
 )
 
-// Serialize serializes an SPN construction into a byte slice.
-func (constr *Construction) Serialize() (out []byte) {
-	for _, layer := range *constr {
+// Magic is the first four bytes of every serialized construction.
+const Magic = "OWBS"
+
+// Version is the version of the serialization format written by Serialize.
+const Version = 1
+
+// Serialize serializes an SPN construction into a byte slice. The output is self-describing:
+//
+//	magic     4 bytes, "OWBS"
+//	version   1 byte, 1
+//	structure 1 byte of length, followed by the structure in function composition notation, e.g. "SAS"
+//	block     2 bytes, the block size in bytes, big-endian
+//	sbox      1 byte, the width of each S-box in bits
+//	layers    each layer in the order it's applied to the input
+//	checksum  4 bytes, the CRC-32 (IEEE) of everything before it, big-endian
+//
+// S-box layers are serialized as the lookup table of each S-box, one byte per entry for S-boxes up to 8 bits wide and
+// two little-endian bytes per entry for wider S-boxes. Affine layers are serialized as the rows of their linear part
+// followed by their constant.
+//
+// The construction is normalized first, so other layers are serialized as the S-box and affine layers they're made of.
+// Serialize returns the error from Normalize if that isn't possible, ErrEmpty if the construction has no layers, and
+// ErrTooLarge if it has more than 255 layers or blocks of 65536 bytes or more, which the header can't describe.
+func (constr *Construction) Serialize() (out []byte, err error) {
+	normalized, err := constr.Normalize()
+	if err != nil {
+		return nil, err
+	}
+	structure, params := normalized.Structure(), normalized.Params()
+
+	if len(structure) == 0 {
+		return nil, ErrEmpty
+	} else if len(structure) > 0xff || params.BlockSize > 0xffff {
+		return nil, ErrTooLarge
+	}
+
+	out = append(out, Magic...)
+	out = append(out, Version)
+	out = append(out, byte(len(structure)))
+	out = append(out, structure...)
+	out = append(out, byte(params.BlockSize>>8), byte(params.BlockSize))
+	out = append(out, byte(params.SBoxSize))
+
+	for _, layer := range normalized {
 		switch layer := layer.(type) {
-		case encoding.ConcatenatedBlock:
-			for pos := 0; pos < 16; pos++ {
-				out = append(out, encoding.SerializeByte(layer[pos])...)
+		case SBoxLayer:
+			for _, sbox := range layer {
+				out = append(out, sbox.serialize()...)
 			}
 
-		case encoding.BlockAffine:
-			for _, row := range layer.BlockLinear.Forwards {
+		case AffineLayer:
+			for _, row := range layer.Forwards {
 				out = append(out, row...)
 			}
-			out = append(out, layer.BlockAdditive[:]...)
+			out = append(out, layer.Constant...)
+		}
+	}
+
+	checksum := crc32.ChecksumIEEE(out)
+	out = append(out, byte(checksum>>24), byte(checksum>>16), byte(checksum>>8), byte(checksum))
+
+	return out, nil
+}
+
+// sboxEntrySize returns the number of bytes each entry of a serialized S-box of the given width takes.
+func sboxEntrySize(width int) int {
+	return (width + 7) / 8
+}
+
+// serialize writes the S-box's lookup table.
+func (s SBox) serialize() (out []byte) {
+	size := sboxEntrySize(s.Width())
+
+	for _, y := range s.EncKey {
+		out = append(out, byte(y))
+		if size == 2 {
+			out = append(out, byte(y>>8))
 		}
 	}
 
 	return
 }
 
-func parseSBoxLayer(constr *Construction, in *[]byte) {
-	sbox := encoding.ConcatenatedBlock{}
+// parseSBox parses an S-box of the given width from the start of in. It returns ErrNotBijective if the lookup table
+// isn't a permutation.
+func parseSBox(in []byte, width int) (SBox, error) {
+	size := sboxEntrySize(width)
+	encKey := make([]uint16, 1<<uint(width))
+	seen := make([]bool, len(encKey))
+
+	for x := range encKey {
+		encKey[x] = uint16(in[size*x])
+		if size == 2 {
+			encKey[x] |= uint16(in[size*x+1]) << 8
+		}
+
+		if int(encKey[x]) >= len(encKey) || seen[encKey[x]] {
+			return SBox{}, ErrNotBijective
+		}
+		seen[encKey[x]] = true
+	}
+
+	return NewSBox(encKey), nil
+}
+
+// serializedSize returns the length of a serialized construction with the given structure and dimensions.
+func serializedSize(structure Structure, params Params) (size int) {
+	blockSize := params.BlockSize
+
+	for _, layer := range structure.Layers() {
+		switch layer {
+		case Substitution:
+			size += params.SBoxes() * sboxEntrySize(params.SBoxSize) << uint(params.SBoxSize)
+		case Affine:
+			size += 8*blockSize*blockSize + blockSize
+		}
+	}
+
+	return
+}
+
+func parseSBoxLayer(constr *Construction, in *[]byte, params Params) error {
+	sbox := make(SBoxLayer, params.SBoxes())
 	rest := (*in)[:]
+	size := sboxEntrySize(params.SBoxSize) << uint(params.SBoxSize)
 
-	for pos := 0; pos < 16; pos++ {
-		sbox[pos], rest = encoding.ParseByte(rest[0:256]), rest[256:]
+	for pos := range sbox {
+		var err error
+		if sbox[pos], err = parseSBox(rest[0:size], params.SBoxSize); err != nil {
+			return &LayerError{len(*constr), pos, err}
+		}
+		rest = rest[size:]
 	}
 
 	*constr = append(*constr, sbox)
 	*in = rest
+
+	return nil
 }
 
-func parseAffineLayer(constr *Construction, in *[]byte) {
+func parseAffineLayer(constr *Construction, in *[]byte, params Params) error {
 	linear := matrix.Matrix{}
 	rest := (*in)[:]
+	blockSize := params.BlockSize
+
+	for row := 0; row < 8*blockSize; row++ {
+		linear, rest = append(linear, matrix.Row(rest[0:blockSize])), rest[blockSize:]
+	}
+
+	constant := make([]byte, blockSize)
+	copy(constant, rest[0:blockSize])
 
-	for row := 0; row < 128; row++ {
-		linear, rest = append(linear, matrix.Row(rest[0:16])), rest[16:]
+	inv, ok := linear.Invert()
+	if !ok {
+		return &LayerError{len(*constr), -1, ErrSingular}
 	}
 
-	constant := [16]byte{}
-	copy(constant[:], rest[0:16])
+	*constr = append(*constr, AffineLayer{linear, inv, constant})
+	*in = rest[blockSize:]
 
-	*constr = append(*constr, encoding.NewBlockAffine(linear, constant))
-	*in = rest[16:]
+	return nil
 }
 
-// Parse parses a byte array into an SPN construction with the specificed structure. It panics if the byte array is
-// malformed.
-func Parse(in []byte, structure Structure) (constr Construction) {
-	rest := in[:]
-
-	switch structure {
-	case AS:
-		parseSBoxLayer(&constr, &rest)
-		parseAffineLayer(&constr, &rest)
-	case SA:
-		parseAffineLayer(&constr, &rest)
-		parseSBoxLayer(&constr, &rest)
-	case ASA:
-		parseAffineLayer(&constr, &rest)
-		parseSBoxLayer(&constr, &rest)
-		parseAffineLayer(&constr, &rest)
-	case SAS:
-		parseSBoxLayer(&constr, &rest)
-		parseAffineLayer(&constr, &rest)
-		parseSBoxLayer(&constr, &rest)
-	case ASAS:
-		parseSBoxLayer(&constr, &rest)
-		parseAffineLayer(&constr, &rest)
-		parseSBoxLayer(&constr, &rest)
-		parseAffineLayer(&constr, &rest)
-	case SASA:
-		parseAffineLayer(&constr, &rest)
-		parseSBoxLayer(&constr, &rest)
-		parseAffineLayer(&constr, &rest)
-		parseSBoxLayer(&constr, &rest)
-	case ASASA:
-		parseAffineLayer(&constr, &rest)
-		parseSBoxLayer(&constr, &rest)
-		parseAffineLayer(&constr, &rest)
-		parseSBoxLayer(&constr, &rest)
-		parseAffineLayer(&constr, &rest)
-	case SASAS:
-		parseSBoxLayer(&constr, &rest)
-		parseAffineLayer(&constr, &rest)
-		parseSBoxLayer(&constr, &rest)
-		parseAffineLayer(&constr, &rest)
-		parseSBoxLayer(&constr, &rest)
-	default:
-		panic("Unknown SPN structure!")
+// parseHeader parses the header of a serialized construction and checks its length and checksum. It returns the
+// structure and dimensions of the construction, and the serialized layers.
+func parseHeader(in []byte) (structure Structure, params Params, body []byte, err error) {
+	if len(in) < 4 || string(in[0:4]) != Magic {
+		return "", Params{}, nil, ErrBadMagic
+	} else if len(in) < 6 {
+		return "", Params{}, nil, ErrTruncated
+	} else if in[4] != Version {
+		return "", Params{}, nil, ErrUnknownVersion
 	}
 
-	return
+	n := int(in[5])
+	if len(in) < 6+n+3 {
+		return "", Params{}, nil, ErrTruncated
+	}
+
+	structure = Structure(in[6 : 6+n])
+	params.BlockSize = int(in[6+n])<<8 | int(in[6+n+1])
+	params.SBoxSize = int(in[6+n+2])
+
+	if !structure.Valid() || !params.Valid() {
+		return "", Params{}, nil, ErrInvalidHeader
+	}
+
+	// Check the length before the checksum, so that truncated input and trailing data are reported as such.
+	size := 6 + n + 3 + serializedSize(structure, params) + 4
+	if len(in) < size {
+		return "", Params{}, nil, ErrTruncated
+	} else if len(in) > size {
+		return "", Params{}, nil, ErrTrailingData
+	}
+
+	checksum := crc32.ChecksumIEEE(in[:size-4])
+	tail := in[size-4:]
+	if uint32(tail[0])<<24|uint32(tail[1])<<16|uint32(tail[2])<<8|uint32(tail[3]) != checksum {
+		return "", Params{}, nil, ErrChecksum
+	}
+
+	return structure, params, in[6+n+3 : size-4], nil
+}
+
+// Parse parses a byte array into an SPN construction, which must have the specificed structure. It returns
+// ErrWrongStructure if the construction has a different structure, and otherwise behaves like ParseAny.
+//
+// It also parses the format written before serialized constructions had a header: the layers of a construction with
+// 128-bit blocks and 8-bit S-boxes, exactly as above, with no checksum. Input in that format is recognized by not
+// parsing as the current format and being exactly as long as a construction with the given structure. It can be
+// converted by serializing the result again.
+func Parse(in []byte, structure Structure) (Construction, error) {
+	constr, err := ParseAny(in)
+	if err != nil && structure.Valid() && len(in) == serializedSize(structure, DefaultParams) {
+		constr, err = parseLayers(in, structure, DefaultParams)
+	}
+
+	if err != nil {
+		return nil, err
+	} else if constr.Structure() != structure {
+		return nil, ErrWrongStructure
+	}
+
+	return constr, nil
+}
+
+// ParseAny parses a byte array into an SPN construction, reading the structure and dimensions from the byte array. It
+// returns one of the Err* errors in this package if the header is malformed, or a *LayerError wrapping ErrNotBijective
+// or ErrSingular if a layer isn't invertible.
+func ParseAny(in []byte) (Construction, error) {
+	structure, params, rest, err := parseHeader(in)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseLayers(rest, structure, params)
+}
+
+// parseLayers parses the serialized layers of a construction with the given structure and dimensions. The input must be
+// exactly as long as they are.
+func parseLayers(rest []byte, structure Structure, params Params) (constr Construction, err error) {
+	constr = Construction{}
+
+	for _, layer := range structure.Layers() {
+		switch layer {
+		case Substitution:
+			err = parseSBoxLayer(&constr, &rest, params)
+		case Affine:
+			err = parseAffineLayer(&constr, &rest, params)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return constr, nil
 }
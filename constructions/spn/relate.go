@@ -0,0 +1,189 @@
+package spn
+
+import (
+	"github.com/OpenWhiteBox/Generic/internal/gf2"
+)
+
+// ChunkMap is an invertible affine map on blocks which sends chunk i of its input through Maps[i] to chunk Perm[i] of
+// its output.
+type ChunkMap struct {
+	Perm []int
+	Maps []AffineMap
+}
+
+// identityChunkMap returns the identity on blocks of the given number of width-bit chunks.
+func identityChunkMap(chunks, width int) ChunkMap {
+	cm := ChunkMap{make([]int, chunks), make([]AffineMap, chunks)}
+	for i := range cm.Perm {
+		cm.Perm[i], cm.Maps[i] = i, IdentityMap(width)
+	}
+
+	return cm
+}
+
+// Inverse returns the map which undoes this one.
+func (cm ChunkMap) Inverse() ChunkMap {
+	out := ChunkMap{make([]int, len(cm.Perm)), make([]AffineMap, len(cm.Maps))}
+	for i, j := range cm.Perm {
+		out.Perm[j], out.Maps[j] = i, cm.Maps[i].Inverse()
+	}
+
+	return out
+}
+
+// Layer returns the map as an affine layer.
+func (cm ChunkMap) Layer() AffineLayer {
+	return composeAffine(chunkPermutation(cm.Perm, cm.Maps[0].Width()), ChunkLayer(cm.Maps))
+}
+
+// chunkMapOf returns the chunk map on blocks of blockSize bytes which agrees with f, if f looks like one. It only checks
+// which chunk each input chunk moves to, so f is assumed to be affine.
+func chunkMapOf(f func(dst, src []byte), blockSize, width int) (ChunkMap, bool) {
+	chunks := 8 * blockSize / width
+	cm := ChunkMap{make([]int, chunks), make([]AffineMap, chunks)}
+
+	zero, constant := make([]byte, blockSize), make([]byte, blockSize)
+	f(constant, zero)
+
+	image := func(i int, x uint16) []byte {
+		in, out := make([]byte, blockSize), make([]byte, blockSize)
+		gf2.SetChunk(in, i*width, width, x)
+		f(out, in)
+
+		return out
+	}
+
+	seen := make([]bool, chunks)
+	for i := range cm.Perm {
+		cm.Perm[i] = -1
+
+		for b := 0; b < width; b++ {
+			out := image(i, 1<<uint(b))
+
+			for j := 0; j < chunks; j++ {
+				if gf2.GetChunk(out, j*width, width) == gf2.GetChunk(constant, j*width, width) {
+					continue
+				} else if cm.Perm[i] != -1 && cm.Perm[i] != j {
+					return cm, false
+				}
+				cm.Perm[i] = j
+			}
+		}
+
+		if cm.Perm[i] == -1 || seen[cm.Perm[i]] {
+			return cm, false
+		}
+		seen[cm.Perm[i]] = true
+
+		cm.Maps[i] = affineMapOf(width, func(x uint16) uint16 { return gf2.GetChunk(image(i, x), cm.Perm[i]*width, width) })
+		if !cm.Maps[i].invertible() {
+			return cm, false
+		}
+	}
+
+	return cm, true
+}
+
+// SBoxRelation relates an S-box of one construction to the S-box of another that it corresponds to.
+type SBoxRelation struct {
+	// Position is the position of the S-box in the first construction.
+	Position int
+	// A and B are the affine maps on its input and output: the S-box in the second construction is B∘S∘A, where S is
+	// the S-box in the first.
+	A, B AffineMap
+}
+
+// LayerRelation relates a layer of one construction to the same layer of another which computes the same function.
+type LayerRelation struct {
+	// Input and Output are the maps around the layer: the second construction's layer is Output∘L∘Input, where L is the
+	// first construction's layer.
+	Input, Output ChunkMap
+	// SBoxes relates each S-box in the second construction's layer to one in the first's. It's nil for affine layers.
+	SBoxes []SBoxRelation
+}
+
+// Relate finds how the layers of two constructions which compute the same function relate to each other, when they
+// differ by invertible affine maps on each S-box's input and output and by the order of the S-boxes between two affine
+// layers. This is the freedom that an attack can't resolve, so constr2 is usually a decomposition of constr1. Both are
+// normalized, and adjacent layers of the same type are composed, before they're compared, so the relations are for
+// those layers. Every relation is checked exactly.
+//
+// It returns ErrWrongStructure if the constructions don't have the same structure, a *LayerError wrapping ErrNotRelated
+// if a layer can't be related, or any error Normalize returns.
+func Relate(constr1, constr2 Construction) ([]LayerRelation, error) {
+	layers1, err := constr1.Normalize()
+	if err != nil {
+		return nil, err
+	}
+	layers2, err := constr2.Normalize()
+	if err != nil {
+		return nil, err
+	}
+	layers1, layers2 = merge(layers1), merge(layers2)
+
+	if layers1.Structure() != layers2.Structure() || layers1.BlockSize() != layers2.BlockSize() {
+		return nil, ErrWrongStructure
+	}
+
+	blockSize, width := layers1.BlockSize(), layers1.Params().SBoxSize
+	if layers2.Params().SBoxSize != width {
+		return nil, ErrWrongStructure
+	}
+	chunks := 8 * blockSize / width
+
+	out := make([]LayerRelation, len(layers1))
+	before := identityChunkMap(chunks, width)
+
+	for k := range layers1 {
+		input := before.Inverse()
+		inputLayer := input.Layer()
+
+		// The map after this layer is the second construction's layer after the first's is undone.
+		after := identityChunkMap(chunks, width)
+		if k < len(layers1)-1 {
+			var ok bool
+			after, ok = chunkMapOf(func(dst, src []byte) {
+				layers1[k].Decode(dst, src)
+				inputLayer.Decode(dst, dst)
+				layers2[k].Encode(dst, dst)
+			}, blockSize, width)
+
+			if !ok {
+				return nil, &LayerError{k, -1, ErrNotRelated}
+			}
+		}
+
+		out[k] = LayerRelation{Input: input, Output: after}
+
+		switch layer1 := layers1[k].(type) {
+		case AffineLayer:
+			if !equalLayers(composeAffine(after.Layer(), composeAffine(layer1, inputLayer)), layers2[k]) {
+				return nil, &LayerError{k, -1, ErrNotRelated}
+			}
+
+		case SBoxLayer:
+			layer2 := layers2[k].(SBoxLayer)
+			out[k].SBoxes = make([]SBoxRelation, len(layer2))
+
+			for i, sbox := range layer1 {
+				j := before.Perm[i]
+				if after.Perm[i] != j {
+					return nil, &LayerError{k, j, ErrNotRelated}
+				}
+
+				rel := SBoxRelation{i, before.Maps[i].Inverse(), after.Maps[i]}
+				for x := range layer2[j].EncKey {
+					if layer2[j].Encode(uint16(x)) != rel.B.Apply(sbox.Encode(rel.A.Apply(uint16(x)))) {
+						return nil, &LayerError{k, j, ErrNotRelated}
+					}
+				}
+
+				out[k].SBoxes[j] = rel
+			}
+		}
+
+		before = after
+	}
+
+	return out, nil
+}
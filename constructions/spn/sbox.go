@@ -0,0 +1,107 @@
+package spn
+
+import (
+	"io"
+
+	"github.com/OpenWhiteBox/Generic/internal/gf2"
+	"github.com/OpenWhiteBox/Generic/internal/random"
+)
+
+// SBox is a bijection on Width-bit values.
+type SBox struct {
+	EncKey, DecKey []uint16
+}
+
+// NewSBox returns the S-box which sends x to encKey[x]. The length of encKey must be a power of two and encKey must be a
+// permutation of 0, 1, ..., len(encKey)-1.
+func NewSBox(encKey []uint16) SBox {
+	decKey := make([]uint16, len(encKey))
+	for x, y := range encKey {
+		decKey[y] = uint16(x)
+	}
+
+	return SBox{encKey, decKey}
+}
+
+// GenerateSBox generates a random S-box of the given width using the random source random (for example,
+// crypto/rand.Reader). It panics if the random source fails.
+func GenerateSBox(rand io.Reader, width int) SBox {
+	encKey := make([]uint16, 1<<uint(width))
+	for x := range encKey {
+		encKey[x] = uint16(x)
+	}
+
+	// Fisher-Yates shuffle.
+	for i := len(encKey) - 1; i > 0; i-- {
+		j := randomIndex(rand, i+1)
+		encKey[i], encKey[j] = encKey[j], encKey[i]
+	}
+
+	return NewSBox(encKey)
+}
+
+// randomIndex returns a uniformly random integer in [0, n), for n at most 2^16, by rejection sampling.
+func randomIndex(rand io.Reader, n int) int {
+	mask := 1
+	for mask < n {
+		mask <<= 1
+	}
+	mask--
+
+	buf := [2]byte{}
+	for {
+		random.ReadFull(rand, buf[:])
+
+		if x := (int(buf[0]) | int(buf[1])<<8) & mask; x < n {
+			return x
+		}
+	}
+}
+
+// Width returns the number of bits the S-box operates on.
+func (s SBox) Width() (width int) {
+	for 1<<uint(width) < len(s.EncKey) {
+		width++
+	}
+
+	return
+}
+
+func (s SBox) Encode(x uint16) uint16 { return s.EncKey[x] }
+func (s SBox) Decode(x uint16) uint16 { return s.DecKey[x] }
+
+// SBoxLayer applies independent S-boxes to consecutive chunks of its input. The first S-box is applied to the lowest
+// bits of the first byte.
+type SBoxLayer []SBox
+
+// BlockSize returns the number of bytes the layer operates on.
+func (sl SBoxLayer) BlockSize() int {
+	bits := 0
+	for _, sbox := range sl {
+		bits += sbox.Width()
+	}
+
+	return bits / 8
+}
+
+func (sl SBoxLayer) Encode(dst, src []byte) {
+	copy(dst, src)
+
+	offset := 0
+	for _, sbox := range sl {
+		width := sbox.Width()
+		gf2.SetChunk(dst, offset, width, sbox.Encode(gf2.GetChunk(dst, offset, width)))
+		offset += width
+	}
+}
+
+func (sl SBoxLayer) Decode(dst, src []byte) {
+	copy(dst, src)
+
+	offset := 0
+	for _, sbox := range sl {
+		width := sbox.Width()
+		gf2.SetChunk(dst, offset, width, sbox.Decode(gf2.GetChunk(dst, offset, width)))
+		offset += width
+	}
+}
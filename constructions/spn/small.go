@@ -2,62 +2,69 @@ package spn
 
 import (
 	"io"
-
-	"github.com/OpenWhiteBox/primitives/encoding"
-	"github.com/OpenWhiteBox/primitives/matrix"
+	"strings"
 )
 
-func newSmallAffineLayer(rand io.Reader) encoding.ByteAffine {
-	c := [1]byte{}
-	rand.Read(c[:])
+// SmallParams are the dimensions of a small SPN: 8-bit blocks and 4-bit S-boxes.
+var SmallParams = Params{BlockSize: 1, SBoxSize: 4}
+
+// SmallConstruction is an SPN on 8-bit blocks with two 4-bit S-boxes in each S-box layer. It's small enough to check
+// attacks on by hand. It implements encoding.Byte.
+type SmallConstruction Construction
 
-	return encoding.NewByteAffine(matrix.GenerateRandom(rand, 8), c[0])
+// NewSmallSPN generates a random small SPN instance using the random source random (for example, crypto/rand.Reader),
+// with the specified structure.
+func NewSmallSPN(rand io.Reader, structure Structure) SmallConstruction {
+	return SmallConstruction(NewSPNWithParams(rand, structure, SmallParams))
 }
 
-func newSmallSBoxLayer(rand io.Reader) encoding.ConcatenatedByte {
-	return encoding.ConcatenatedByte{
-		encoding.GenerateShuffle(rand),
-		encoding.GenerateShuffle(rand),
+// ParseSmall parses a byte array into a small SPN construction, which must have the specified structure. It returns
+// the same errors as Parse, and ErrInvalidHeader if the construction isn't small. The S-box size is only checked if the
+// construction has an S-box layer, since Params can't tell what it is otherwise.
+func ParseSmall(in []byte, structure Structure) (SmallConstruction, error) {
+	constr, err := Parse(in, structure)
+	if err != nil {
+		return nil, err
 	}
-}
 
-// NewSPN generates a random SPN instance using the random source random (for example, crypto/rand.Reader), with the
-// specified structure.
-func NewSmallSPN(rand io.Reader, structure Structure) encoding.Byte {
-	switch structure {
-	case AS:
-		return encoding.ComposedBytes{
-			newSmallSBoxLayer(rand), newSmallAffineLayer(rand),
-		}
-	case SA:
-		return encoding.ComposedBytes{
-			newSmallAffineLayer(rand), newSmallSBoxLayer(rand),
-		}
-	case ASA:
-		return encoding.ComposedBytes{
-			newSmallAffineLayer(rand), newSmallSBoxLayer(rand), newSmallAffineLayer(rand),
-		}
-	case SAS:
-		return encoding.ComposedBytes{
-			newSmallSBoxLayer(rand), newSmallAffineLayer(rand), newSmallSBoxLayer(rand),
-		}
-	case ASAS:
-		return encoding.ComposedBytes{
-			newSmallSBoxLayer(rand), newSmallAffineLayer(rand), newSmallSBoxLayer(rand), newSmallAffineLayer(rand),
-		}
-	case SASA:
-		return encoding.ComposedBytes{
-			newSmallAffineLayer(rand), newSmallSBoxLayer(rand), newSmallAffineLayer(rand), newSmallSBoxLayer(rand),
-		}
-	case ASASA:
-		return encoding.ComposedBytes{
-			newSmallAffineLayer(rand), newSmallSBoxLayer(rand), newSmallAffineLayer(rand), newSmallSBoxLayer(rand), newSmallAffineLayer(rand),
-		}
-	case SASAS:
-		return encoding.ComposedBytes{
-			newSmallSBoxLayer(rand), newSmallAffineLayer(rand), newSmallSBoxLayer(rand), newSmallAffineLayer(rand), newSmallSBoxLayer(rand),
-		}
-	default:
-		panic("Unknown SPN structure!")
+	params, sboxes := constr.Params(), strings.ContainsRune(string(structure), rune(Substitution))
+	if params.BlockSize != SmallParams.BlockSize || sboxes && params.SBoxSize != SmallParams.SBoxSize {
+		return nil, ErrInvalidHeader
 	}
+
+	return SmallConstruction(constr), nil
+}
+
+// Encrypt encrypts one 8-bit block.
+func (sc SmallConstruction) Encrypt(in byte) byte {
+	out := [1]byte{in}
+	Construction(sc).Encrypt(out[:], out[:])
+
+	return out[0]
+}
+
+// Decrypt decrypts one 8-bit block.
+func (sc SmallConstruction) Decrypt(in byte) byte {
+	out := [1]byte{in}
+	Construction(sc).Decrypt(out[:], out[:])
+
+	return out[0]
+}
+
+// Encode is the same as Encrypt. (Necessary to implement encoding.Byte.)
+func (sc SmallConstruction) Encode(in byte) byte { return sc.Encrypt(in) }
+
+// Decode is the same as Decrypt. (Necessary to implement encoding.Byte.)
+func (sc SmallConstruction) Decode(in byte) byte { return sc.Decrypt(in) }
+
+// Structure returns the structure of the construction.
+func (sc SmallConstruction) Structure() Structure { return Construction(sc).Structure() }
+
+// Layers returns the layers of the construction, in the order they're applied to the input.
+func (sc SmallConstruction) Layers() Construction { return Construction(sc) }
+
+// Serialize serializes a small SPN construction into a byte slice, in the same format as Construction.Serialize.
+func (sc SmallConstruction) Serialize() ([]byte, error) {
+	constr := Construction(sc)
+	return constr.Serialize()
 }
@@ -1,54 +1,90 @@
-// Package spn implements a generic SPN block ciphers with 128-bit blocks and 8-bit S-boxes.
+// Package spn implements a generic SPN block ciphers. By default, blocks are 128 bits and S-boxes are 8 bits, but any
+// whole number of bytes and any S-box width from 1 to 16 bits that divides the block is supported.
 //
 // An affine layer, denoted by an A, treats its input as an element of GF(2)^n and applies a fixed, invertible affine
-// transformation over this space. An S-box layer, denoted by an S, applies possibly independent 8-bit S-boxes to
-// consecutive chunks of its input. The layers are concatenated as in function composition notation. A block cipher E
+// transformation over this space. An S-box layer, denoted by an S, applies possibly independent S-boxes to consecutive
+// chunks of its input. The layers are concatenated as in function composition notation. A block cipher E
 // with structure ASAS implies E = A(S(A(S(x)))).
 //
+// Many constructions compute the same function, since an affine map on each S-box's input or output can be moved into
+// the neighboring affine layer. Canonical picks one of them, so constructions can be compared exactly, and Equivalent
+// uses it to decide whether two constructions compute the same function.
+//
 // An efficient cryptanalysis of many of these block ciphers is implemented in the cryptanalysis/spn package.
 //
 // "Structural Cryptanalysis of SASAS" by Alex Biryukov and Adi Shamir,
 // https://www.iacr.org/archive/eurocrypt2001/20450392.pdf
 package spn
 
-import (
-	"github.com/OpenWhiteBox/primitives/encoding"
-)
+// Construction is an SPN, given as the sequence of its layers in the order they're applied to the input.
+type Construction []Layer
+
+// BlockSize returns the block size of the cipher. (Necessary to implement cipher.Block.)
+func (constr Construction) BlockSize() int {
+	if len(constr) == 0 {
+		return 16
+	}
+
+	return constr[0].BlockSize()
+}
 
-type Structure int
+// Structure returns the structure of the construction. Layers other than S-box and affine layers are skipped, so
+// constructions containing them should be normalized first.
+func (constr Construction) Structure() Structure {
+	out := []byte{}
 
-const (
-	AS Structure = iota
-	SA
-	ASA
-	SAS
-	ASAS
-	SASA
-	ASASA
-	SASAS
-)
+	for i := len(constr) - 1; i >= 0; i-- {
+		layer := constr[i]
+		if block, ok := layer.(Block); ok {
+			layer = FromBlock(block.Block)
+		}
 
-type Construction encoding.ComposedBlocks
+		switch layer.(type) {
+		case SBoxLayer:
+			out = append(out, byte(Substitution))
+		case AffineLayer:
+			out = append(out, byte(Affine))
+		}
+	}
 
-// BlockSize returns the block size of the cipher. (Necessary to implement cipher.Block.)
-func (constr Construction) BlockSize() int { return 16 }
+	return Structure(out)
+}
+
+// Params returns the dimensions of the construction. The S-box size is taken from the first S-box, or is 8 if there are
+// no S-boxes.
+func (constr Construction) Params() Params {
+	params := Params{BlockSize: constr.BlockSize(), SBoxSize: 8}
+
+	for _, layer := range constr {
+		if sl, ok := layer.(SBoxLayer); ok && len(sl) > 0 {
+			params.SBoxSize = sl[0].Width()
+			break
+		}
+	}
+
+	return params
+}
 
 // Encrypt encrypts the first block in src into dst. Dst and src may point at the same memory.
 func (constr Construction) Encrypt(dst, src []byte) {
-	temp := [16]byte{}
-	copy(temp[:], src)
+	temp := make([]byte, constr.BlockSize())
+	copy(temp, src)
 
-	temp = encoding.ComposedBlocks(constr).Encode(temp)
+	for _, layer := range constr {
+		layer.Encode(temp, temp)
+	}
 
-	copy(dst, temp[:])
+	copy(dst, temp)
 }
 
 // Decrypt decrypts the first block in src into dst. Dst and src may point at the same memory.
 func (constr Construction) Decrypt(dst, src []byte) {
-	temp := [16]byte{}
-	copy(temp[:], src)
+	temp := make([]byte, constr.BlockSize())
+	copy(temp, src)
 
-	temp = encoding.ComposedBlocks(constr).Decode(temp)
+	for i := len(constr) - 1; i >= 0; i-- {
+		constr[i].Decode(temp, temp)
+	}
 
-	copy(dst, temp[:])
+	copy(dst, temp)
 }
@@ -5,8 +5,25 @@ import (
 
 	"bytes"
 	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"strings"
+
+	"github.com/OpenWhiteBox/primitives/encoding"
+
+	"github.com/OpenWhiteBox/Generic/internal/gf2"
 )
 
+func mustSerialize(t testing.TB, constr Construction) []byte {
+	serialized, err := constr.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return serialized
+}
+
 func Example_encrypt() {
 	constr := NewSPN(rand.Reader, SAS) // crypto/rand.Reader
 
@@ -32,8 +49,11 @@ func TestEncrypt(t *testing.T) {
 func TestPersistence(t *testing.T) {
 	constr := NewSPN(rand.Reader, SAS)
 
-	serialized := constr.Serialize()
-	constr2 := Parse(serialized, SAS)
+	serialized := mustSerialize(t, constr)
+	constr2, err := Parse(serialized, SAS)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	in := make([]byte, 16)
 	rand.Read(in)
@@ -48,3 +68,702 @@ func TestPersistence(t *testing.T) {
 		t.Fatalf("Parse/Serialize are wrong.")
 	}
 }
+
+func TestSerializeBlocks(t *testing.T) {
+	constr := NewSPN(rand.Reader, ASA)
+	inner := Construction{constr[1], constr[2]}
+
+	// Wrap the last two layers in an encoding.Block and invert them twice.
+	wrapped := Construction{
+		constr[0],
+		Block{encoding.InverseBlock{encoding.InverseBlock{encoding.ComposedBlocks{ToBlock(inner[0]), ToBlock(inner[1])}}}},
+	}
+
+	constr2, err := Parse(mustSerialize(t, wrapped), ASA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in, out, out2 := make([]byte, 16), make([]byte, 16), make([]byte, 16)
+	rand.Read(in)
+
+	constr.Encrypt(out, in)
+	constr2.Encrypt(out2, in)
+
+	if !bytes.Equal(out, out2) {
+		t.Fatal("Normalized construction is wrong.")
+	}
+
+	unknown := Construction{unknownLayer{}}
+	if _, err := unknown.Serialize(); !errors.Is(err, ErrUnsupportedLayer) {
+		t.Fatalf("Got error %v, expected %v.", err, ErrUnsupportedLayer)
+	}
+
+	// An unknown block is rejected even if it behaves like a known layer, since that can't be checked on every input.
+	opaque := Construction{Block{opaqueBlock{}}}
+	if _, err := opaque.Serialize(); !errors.Is(err, ErrUnsupportedLayer) {
+		t.Fatalf("Got error %v, expected %v.", err, ErrUnsupportedLayer)
+	}
+
+	// The header can't describe a construction without layers.
+	empty := Construction{}
+	if _, err := empty.Serialize(); err != ErrEmpty {
+		t.Fatalf("Got error %v, expected %v.", err, ErrEmpty)
+	}
+
+	// The header only has one byte for the length of the structure.
+	long := NewSPNWithParams(rand.Reader, Structure(strings.Repeat("SA", 128)), SmallParams)
+	if _, err := long.Serialize(); err != ErrTooLarge {
+		t.Fatalf("Got error %v, expected %v.", err, ErrTooLarge)
+	}
+}
+
+type unknownLayer struct{}
+
+func (unknownLayer) BlockSize() int         { return 16 }
+func (unknownLayer) Encode(dst, src []byte) { copy(dst, src) }
+func (unknownLayer) Decode(dst, src []byte) { copy(dst, src) }
+
+// opaqueBlock is the identity, as an encoding.Block of a type that isn't recognized.
+type opaqueBlock struct{}
+
+func (opaqueBlock) Encode(in [16]byte) [16]byte { return in }
+func (opaqueBlock) Decode(in [16]byte) [16]byte { return in }
+
+func TestSelfDescribing(t *testing.T) {
+	params := Params{BlockSize: 8, SBoxSize: 4}
+
+	for _, structure := range []Structure{SA, AS, "SASASAS"} {
+		constr := NewSPNWithParams(rand.Reader, structure, params)
+		constr2, err := ParseAny(mustSerialize(t, constr))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if constr2.Structure() != structure {
+			t.Fatalf("Parsed structure %v, expected %v.", constr2.Structure(), structure)
+		} else if constr2.Params() != params {
+			t.Fatalf("Parsed dimensions %v, expected %v.", constr2.Params(), params)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	constr := NewSPNWithParams(rand.Reader, SA, Params{BlockSize: 4, SBoxSize: 4})
+	serialized := mustSerialize(t, constr)
+
+	// Offsets into the serialized construction: the header is 11 bytes, then comes the affine layer (32 rows of 4 bytes
+	// and a 4-byte constant), then the S-box layer.
+	flip := func(i int) []byte {
+		out := append([]byte{}, serialized...)
+		out[i] ^= 0x01
+		return out
+	}
+	corrupt := func(f func([]byte)) []byte {
+		out := append([]byte{}, serialized...)
+		f(out)
+
+		checksum := crc32.ChecksumIEEE(out[:len(out)-4])
+		out[len(out)-4], out[len(out)-3], out[len(out)-2], out[len(out)-1] =
+			byte(checksum>>24), byte(checksum>>16), byte(checksum>>8), byte(checksum)
+
+		return out
+	}
+
+	cases := []struct {
+		in  []byte
+		err error
+	}{
+		{[]byte("nope"), ErrBadMagic},
+		{serialized[:8], ErrTruncated},
+		{serialized[:len(serialized)-1], ErrTruncated},
+		{append(append([]byte{}, serialized...), 0x00), ErrTrailingData},
+		{corrupt(func(in []byte) { in[4] = 2 }), ErrUnknownVersion},
+		{corrupt(func(in []byte) { in[6] = 'X' }), ErrInvalidHeader},
+		{flip(20), ErrChecksum},
+		{corrupt(func(in []byte) { copy(in[11:15], in[15:19]) }), ErrSingular},
+		{corrupt(func(in []byte) { in[11+132] = in[11+133] }), ErrNotBijective},
+	}
+
+	for i, c := range cases {
+		if _, err := ParseAny(c.in); !errors.Is(err, c.err) {
+			t.Fatalf("Case %v: got error %v, expected %v.", i, err, c.err)
+		}
+	}
+
+	if _, err := Parse(serialized, AS); err != ErrWrongStructure {
+		t.Fatalf("Got error %v, expected %v.", err, ErrWrongStructure)
+	}
+}
+
+func TestParseLegacy(t *testing.T) {
+	constr := NewSPN(rand.Reader, SASA)
+	serialized := mustSerialize(t, constr)
+
+	// Before the header was added, only the layers were serialized.
+	legacy := serialized[6+len(SASA)+3 : len(serialized)-4]
+
+	constr2, err := Parse(legacy, SASA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in, out, out2 := make([]byte, 16), make([]byte, 16), make([]byte, 16)
+	rand.Read(in)
+
+	constr.Encrypt(out, in)
+	constr2.Encrypt(out2, in)
+
+	if !bytes.Equal(out, out2) {
+		t.Fatal("Parsed legacy construction is wrong.")
+	}
+
+	if _, err := ParseAny(legacy); err != ErrBadMagic {
+		t.Fatalf("Got error %v, expected %v.", err, ErrBadMagic)
+	} else if _, err := Parse(legacy[1:], SASA); err != ErrBadMagic {
+		t.Fatalf("Got error %v, expected %v.", err, ErrBadMagic)
+	}
+}
+
+func FuzzParseAny(f *testing.F) {
+	for _, structure := range []Structure{SA, ASA, SASAS} {
+		constr := NewSPNWithParams(rand.Reader, structure, Params{BlockSize: 2, SBoxSize: 4})
+		f.Add(mustSerialize(f, constr))
+	}
+
+	f.Fuzz(func(t *testing.T, in []byte) {
+		constr, err := ParseAny(in)
+		if err != nil {
+			return
+		}
+
+		out := make([]byte, constr.BlockSize())
+		constr.Encrypt(out, out)
+		constr.Decrypt(out, out)
+
+		for _, b := range out {
+			if b != 0 {
+				t.Fatal("Parsed construction isn't invertible.")
+			}
+		}
+	})
+}
+
+func TestBlockSizes(t *testing.T) {
+	for _, blockSize := range []int{4, 8, 12, 24, 32} {
+		constr := NewSPNWithParams(rand.Reader, SASAS, Params{BlockSize: blockSize, SBoxSize: 8})
+
+		if constr.BlockSize() != blockSize {
+			t.Fatalf("Wrong block size: %v != %v", constr.BlockSize(), blockSize)
+		}
+
+		constr2, err := Parse(mustSerialize(t, constr), SASAS)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		in := make([]byte, blockSize)
+		rand.Read(in)
+
+		out, out2, out3 := make([]byte, blockSize), make([]byte, blockSize), make([]byte, blockSize)
+		constr.Encrypt(out, in)
+		constr2.Encrypt(out2, in)
+		constr.Decrypt(out3, out)
+
+		if !bytes.Equal(out, out2) {
+			t.Fatalf("Parse/Serialize are wrong with %v-byte blocks.", blockSize)
+		} else if !bytes.Equal(in, out3) {
+			t.Fatalf("Correctness property is not satisfied with %v-byte blocks.", blockSize)
+		}
+	}
+}
+
+func TestSBoxSizes(t *testing.T) {
+	for _, params := range []Params{{16, 4}, {12, 6}, {16, 8}, {16, 16}} {
+		constr := NewSPNWithParams(rand.Reader, SASAS, params)
+
+		if len(constr[0].(SBoxLayer)) != params.SBoxes() {
+			t.Fatalf("Wrong number of S-boxes: %v != %v", len(constr[0].(SBoxLayer)), params.SBoxes())
+		}
+
+		constr2, err := Parse(mustSerialize(t, constr), SASAS)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		in := make([]byte, params.BlockSize)
+		rand.Read(in)
+
+		out, out2, out3 := make([]byte, params.BlockSize), make([]byte, params.BlockSize), make([]byte, params.BlockSize)
+		constr.Encrypt(out, in)
+		constr2.Encrypt(out2, in)
+		constr.Decrypt(out3, out)
+
+		if !bytes.Equal(out, out2) {
+			t.Fatalf("Parse/Serialize are wrong with %v-bit S-boxes.", params.SBoxSize)
+		} else if !bytes.Equal(in, out3) {
+			t.Fatalf("Correctness property is not satisfied with %v-bit S-boxes.", params.SBoxSize)
+		}
+	}
+}
+
+func TestStructure(t *testing.T) {
+	structure, err := ParseStructure("sasasas")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if structure.String() != "SASASAS" {
+		t.Fatalf("Wrong structure: %v", structure)
+	}
+
+	if structure.Outer() != Substitution || structure.Inner() != "ASASAS" {
+		t.Fatal("Wrong outer layer.")
+	}
+
+	if Structure("AASSA").Reduce() != ASA {
+		t.Fatal("Consecutive layers weren't merged.")
+	}
+
+	if SASA.Inverse() != ASAS || Structure("AASSA").Inverse() != "ASSAA" {
+		t.Fatal("Wrong inverse structure.")
+	}
+
+	for _, bad := range []string{"", "SAX", "S A"} {
+		if _, err := ParseStructure(bad); err != ErrInvalidStructure {
+			t.Fatalf("Parsed invalid structure %q.", bad)
+		}
+	}
+
+	constr := NewSPN(rand.Reader, structure)
+	if len(constr) != 7 {
+		t.Fatalf("Wrong number of layers: %v", len(constr))
+	}
+}
+
+func TestSmall(t *testing.T) {
+	constr := NewSmallSPN(rand.Reader, SASAS)
+
+	if constr.Structure() != SASAS {
+		t.Fatalf("Wrong structure: %v", constr.Structure())
+	} else if len(constr.Layers()[0].(SBoxLayer)) != 2 {
+		t.Fatal("Small S-box layers should have two S-boxes.")
+	}
+
+	constr2, err := ParseSmall(mustSerialize(t, constr.Layers()), SASAS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := [256]bool{}
+	for x := 0; x < 256; x++ {
+		y := constr.Encrypt(byte(x))
+
+		if seen[y] {
+			t.Fatal("Small SPN isn't a permutation.")
+		} else if constr.Decrypt(y) != byte(x) {
+			t.Fatal("Correctness property is not satisfied.")
+		} else if constr2.Encrypt(byte(x)) != y {
+			t.Fatal("ParseSmall/Serialize are wrong.")
+		}
+		seen[y] = true
+	}
+
+	if _, err := ParseSmall(mustSerialize(t, NewSPN(rand.Reader, SASAS)), SASAS); err != ErrInvalidHeader {
+		t.Fatalf("Got error %v, expected %v.", err, ErrInvalidHeader)
+	}
+
+	// Without an S-box layer, the serialized S-box size isn't the small one.
+	affine := NewSmallSPN(rand.Reader, "A")
+
+	affine2, err := ParseSmall(mustSerialize(t, affine.Layers()), "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for x := 0; x < 256; x++ {
+		if affine2.Encrypt(byte(x)) != affine.Encrypt(byte(x)) {
+			t.Fatal("ParseSmall/Serialize are wrong on an affine layer.")
+		}
+	}
+
+	if _, err := ParseSmall(mustSerialize(t, NewSPN(rand.Reader, "A")), "A"); err != ErrInvalidHeader {
+		t.Fatalf("Got error %v, expected %v.", err, ErrInvalidHeader)
+	}
+}
+
+func TestNewSPNFromKey(t *testing.T) {
+	key, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+
+	constr, err := NewSPNFromKey(key, ASA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct{ in, out string }{
+		{"00000000000000000000000000000000", "a9f5d57eb43c48b33632353f229bafbd"},
+		{"00112233445566778899aabbccddeeff", "1c24d938fff20d6c624b4a70b863a0b7"},
+	}
+
+	for _, c := range cases {
+		in, _ := hex.DecodeString(c.in)
+		out := make([]byte, 16)
+		constr.Encrypt(out, in)
+
+		if hex.EncodeToString(out) != c.out {
+			t.Fatalf("Encrypt(%v) = %x, expected %v", c.in, out, c.out)
+		}
+	}
+
+	small, err := NewSPNFromKeyWithParams(key[:16], SASAS, SmallParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := []byte{}
+	for _, x := range []byte{0x00, 0x01, 0x80, 0xff} {
+		y := []byte{0}
+		small.Encrypt(y, []byte{x})
+		out = append(out, y[0])
+	}
+
+	if hex.EncodeToString(out) != "6dd0a9b6" {
+		t.Fatalf("Small SPN derived from key encrypted to %x, expected 6dd0a9b6", out)
+	}
+
+	if _, err := NewSPNFromKey(key[:5], ASA); err == nil {
+		t.Fatal("NewSPNFromKey accepted a 5-byte key!")
+	}
+
+	// SPNs derived from one key with different structures don't share layers.
+	sas, _ := NewSPNFromKey(key, SAS)
+	sasas, _ := NewSPNFromKey(key, SASAS)
+
+	if bytes.Equal(mustSerialize(t, sas[:1]), mustSerialize(t, sasas[:1])) {
+		t.Fatal("SAS and SASAS derived from the same key share their first layer!")
+	}
+}
+
+func TestShortRandom(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("NewSPN didn't panic when the random source ran out!")
+		}
+	}()
+
+	NewSPN(bytes.NewReader(make([]byte, 100)), ASA)
+}
+
+func TestAffineMap(t *testing.T) {
+	maps := make([]AffineMap, 32)
+	for i := range maps {
+		maps[i] = GenerateAffineMap(rand.Reader, 4)
+	}
+
+	for _, am := range maps {
+		if !am.Inverse().Compose(am).Equal(IdentityMap(4)) {
+			t.Fatal("Affine map composed with its inverse wasn't the identity!")
+		}
+	}
+
+	layer := ChunkLayer(maps)
+	in, out := make([]byte, 16), make([]byte, 16)
+	rand.Read(in)
+	layer.Encode(out, in)
+
+	for i, am := range maps {
+		if gf2.GetChunk(out, 4*i, 4) != am.Apply(gf2.GetChunk(in, 4*i, 4)) {
+			t.Fatalf("Chunk layer applied the wrong map to chunk %v!", i)
+		}
+	}
+
+	layer.Decode(out, out)
+	if !bytes.Equal(in, out) {
+		t.Fatal("Chunk layer didn't invert!")
+	}
+}
+
+// disguise returns a construction computing the same function as constr, with random affine maps on every S-box's input
+// and output that has an affine layer next to it, and the S-boxes between two affine layers shuffled.
+func disguise(constr Construction, width int) Construction {
+	out := append(Construction{}, constr...)
+
+	for k, layer := range out {
+		sl, ok := layer.(SBoxLayer)
+		if !ok {
+			continue
+		}
+
+		next := make(SBoxLayer, len(sl))
+		in, outs := make([]AffineMap, len(sl)), make([]AffineMap, len(sl))
+		perm := make([]int, len(sl))
+		for i := range sl {
+			in[i], outs[i], perm[i] = IdentityMap(width), IdentityMap(width), i
+		}
+
+		if k > 0 {
+			for i := range in {
+				in[i] = GenerateAffineMap(rand.Reader, width)
+			}
+		}
+		if k < len(out)-1 {
+			for i := range outs {
+				outs[i] = GenerateAffineMap(rand.Reader, width)
+			}
+		}
+		if k > 0 && k < len(out)-1 {
+			for i := len(perm) - 1; i > 0; i-- {
+				j := randomIndex(rand.Reader, i+1)
+				perm[i], perm[j] = perm[j], perm[i]
+			}
+		}
+
+		for i, sbox := range sl {
+			inverse := in[i].Inverse()
+
+			encKey := make([]uint16, len(sbox.EncKey))
+			for x := range encKey {
+				encKey[x] = outs[i].Apply(sbox.Encode(inverse.Apply(uint16(x))))
+			}
+			next[perm[i]] = NewSBox(encKey)
+		}
+		out[k] = next
+
+		if k > 0 {
+			out[k-1] = composeAffine(chunkPermutation(perm, width), composeAffine(ChunkLayer(in), out[k-1].(AffineLayer)))
+		}
+		if k < len(out)-1 {
+			out[k+1] = composeAffine(composeAffine(out[k+1].(AffineLayer), ChunkLayer(outs).Inverse()), chunkPermutation(perm, width).Inverse())
+		}
+	}
+
+	return out
+}
+
+func TestCanonical(t *testing.T) {
+	cases := []struct {
+		structure Structure
+		params    Params
+	}{
+		{SASAS, DefaultParams},
+		{ASASA, Params{BlockSize: 16, SBoxSize: 4}},
+		{ASASA, SmallParams},
+		{AS, SmallParams},
+	}
+
+	for _, c := range cases {
+		constr := NewSPNWithParams(rand.Reader, c.structure, c.params)
+
+		canonical, err := constr.Canonical()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		canonical2, err := disguise(constr, c.params.SBoxSize).Canonical()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		other, err := NewSPNWithParams(rand.Reader, c.structure, c.params).Canonical()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if canonical.Structure() != c.structure {
+			t.Fatalf("Canonical form of %v has structure %v!", c.structure, canonical.Structure())
+		} else if !bytes.Equal(mustSerialize(t, canonical), mustSerialize(t, canonical2)) {
+			t.Fatalf("Equivalent %v constructions have different canonical forms!", c.structure)
+		} else if bytes.Equal(mustSerialize(t, canonical), mustSerialize(t, other)) {
+			t.Fatalf("Different %v constructions have the same canonical form!", c.structure)
+		}
+
+		in, out, out2 := make([]byte, c.params.BlockSize), make([]byte, c.params.BlockSize), make([]byte, c.params.BlockSize)
+		for i := 0; i < 16; i++ {
+			rand.Read(in)
+			constr.Encrypt(out, in)
+			canonical.Encrypt(out2, in)
+
+			if !bytes.Equal(out, out2) {
+				t.Fatalf("Canonical form of %v computes a different function!", c.structure)
+			}
+		}
+	}
+
+	merged, err := Construction{newAffineLayer(rand.Reader, DefaultParams), newAffineLayer(rand.Reader, DefaultParams)}.Canonical()
+	if err != nil {
+		t.Fatal(err)
+	} else if merged.Structure() != "A" {
+		t.Fatalf("Adjacent affine layers weren't merged: %v", merged.Structure())
+	}
+}
+
+// swapOutputs returns a copy of constr where two outputs of one S-box in layer k are swapped.
+func swapOutputs(constr Construction, k, pos int) Construction {
+	out := append(Construction{}, constr...)
+	sl := append(SBoxLayer{}, out[k].(SBoxLayer)...)
+
+	encKey := append([]uint16{}, sl[pos].EncKey...)
+	encKey[1], encKey[2] = encKey[2], encKey[1]
+	sl[pos] = NewSBox(encKey)
+
+	out[k] = sl
+	return out
+}
+
+func TestEquivalent(t *testing.T) {
+	for _, params := range []Params{DefaultParams, SmallParams} {
+		constr := NewSPNWithParams(rand.Reader, SASAS, params)
+		disguised := disguise(constr, params.SBoxSize)
+
+		if ok, _, err := Equivalent(constr, disguised); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatalf("Equivalent constructions with %v-byte blocks weren't recognized!", params.BlockSize)
+		}
+
+		for k := 0; k < len(constr); k += 2 {
+			ok, in, err := Equivalent(constr, swapOutputs(disguised, k, 1))
+			if err != nil {
+				t.Fatal(err)
+			} else if ok {
+				t.Fatalf("Constructions differing in layer %v were equivalent!", k)
+			}
+
+			out1, out2 := make([]byte, params.BlockSize), make([]byte, params.BlockSize)
+			constr.Encrypt(out1, in)
+			swapOutputs(disguised, k, 1).Encrypt(out2, in)
+			if bytes.Equal(out1, out2) {
+				t.Fatalf("Input %x doesn't distinguish constructions differing in layer %v!", in, k)
+			}
+		}
+	}
+
+	// Unrelated constructions are told apart by an input they disagree on.
+	params := Params{BlockSize: 16, SBoxSize: 4}
+	constr1, constr2 := NewSPNWithParams(rand.Reader, SASAS, params), NewSPNWithParams(rand.Reader, SASAS, params)
+	if ok, in, err := Equivalent(constr1, constr2); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("Unrelated constructions were equivalent!")
+	} else if in == nil || !disagree(constr1, constr2, in) {
+		t.Fatalf("Input %x doesn't distinguish unrelated constructions!", in)
+	}
+
+	// An identity S-box layer changes the structure without changing the function.
+	affine := newAffineLayer(rand.Reader, DefaultParams)
+	identity := make(SBoxLayer, DefaultParams.SBoxes())
+	for pos := range identity {
+		encKey := make([]uint16, 1<<uint(DefaultParams.SBoxSize))
+		for x := range encKey {
+			encKey[x] = uint16(x)
+		}
+		identity[pos] = NewSBox(encKey)
+	}
+
+	if _, _, err := Equivalent(Construction{affine}, Construction{identity, affine}); err != ErrUndecided {
+		t.Fatalf("Got error %v, expected %v.", err, ErrUndecided)
+	}
+
+	_, _, err := Equivalent(NewSPN(rand.Reader, SAS), NewSmallSPN(rand.Reader, SAS).Layers())
+	if err != ErrBlockSize {
+		t.Fatalf("Got error %v, expected %v.", err, ErrBlockSize)
+	}
+}
+
+func TestRelate(t *testing.T) {
+	constr := NewSPNWithParams(rand.Reader, SASAS, Params{BlockSize: 16, SBoxSize: 4})
+	disguised := disguise(constr, 4)
+
+	relations, err := Relate(constr, disguised)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(relations) != len(constr) {
+		t.Fatalf("Got %v relations for %v layers!", len(relations), len(constr))
+	}
+
+	for k, rel := range relations {
+		if sl, ok := disguised[k].(SBoxLayer); ok {
+			for j, sr := range rel.SBoxes {
+				for x := range sl[j].EncKey {
+					if sl[j].Encode(uint16(x)) != sr.B.Apply(constr[k].(SBoxLayer)[sr.Position].Encode(sr.A.Apply(uint16(x)))) {
+						t.Fatalf("S-box %v of layer %v is related wrongly!", j, k)
+					}
+				}
+			}
+		}
+	}
+
+	if _, err := Relate(constr, swapOutputs(disguised, 2, 1)); !errors.Is(err, ErrNotRelated) {
+		t.Fatalf("Got error %v, expected %v.", err, ErrNotRelated)
+	} else if le, ok := err.(*LayerError); !ok || le.Layer != 2 {
+		t.Fatalf("Unrelated layer reported in the wrong place: %v", err)
+	}
+
+	if _, err := Relate(constr, NewSPNWithParams(rand.Reader, ASASA, Params{BlockSize: 16, SBoxSize: 4})); err != ErrWrongStructure {
+		t.Fatalf("Got error %v, expected %v.", err, ErrWrongStructure)
+	}
+}
+
+// disguiseSBox returns B∘s∘A for random invertible affine maps A and B, along with the maps.
+func disguiseSBox(s SBox) (SBox, AffineEquivalence) {
+	ae := AffineEquivalence{GenerateAffineMap(rand.Reader, s.Width()), GenerateAffineMap(rand.Reader, s.Width())}
+
+	encKey := make([]uint16, len(s.EncKey))
+	for x := range encKey {
+		encKey[x] = ae.B.Apply(s.Encode(ae.A.Apply(uint16(x))))
+	}
+
+	return NewSBox(encKey), ae
+}
+
+func TestAffineEquivalences(t *testing.T) {
+	sboxes := []SBox{NewSmallSPN(rand.Reader, SAS).Layers()[0].(SBoxLayer)[0], NewSPN(rand.Reader, SAS)[0].(SBoxLayer)[0]}
+
+	for _, s1 := range sboxes {
+		s2, expected := disguiseSBox(s1)
+
+		equivalences, err := AffineEquivalences(s1, s2, 1<<12)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		found := false
+		for _, ae := range equivalences {
+			for x := range s1.EncKey {
+				if s2.Encode(uint16(x)) != ae.B.Apply(s1.Encode(ae.A.Apply(uint16(x)))) {
+					t.Fatalf("Wrong affine equivalence between %v-bit S-boxes!", s1.Width())
+				}
+			}
+
+			found = found || (ae.A.Equal(expected.A) && ae.B.Equal(expected.B))
+		}
+		if !found {
+			t.Fatalf("Affine equivalence between %v-bit S-boxes wasn't found!", s1.Width())
+		}
+	}
+
+	if !testing.Short() {
+		if equivalences, err := AffineEquivalences(sboxes[1], GenerateSBox(rand.Reader, 8), 1<<12); err != nil {
+			t.Fatal(err)
+		} else if len(equivalences) != 0 {
+			t.Fatal("Random 8-bit S-boxes were affine equivalent!")
+		}
+	}
+
+	identity := NewSBox([]uint16{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15})
+	present := NewSBox([]uint16{12, 5, 6, 11, 9, 0, 10, 13, 3, 14, 15, 8, 4, 7, 1, 2})
+
+	if equivalences, err := AffineEquivalences(identity, present, 1<<12); err != nil {
+		t.Fatal(err)
+	} else if len(equivalences) != 0 {
+		t.Fatal("Affine and non-affine S-boxes were affine equivalent!")
+	}
+
+	if _, err := AffineEquivalences(identity, identity, 100); err != ErrTooManyEquivalences {
+		t.Fatalf("Got error %v, expected %v.", err, ErrTooManyEquivalences)
+	}
+
+	if _, err := AffineEquivalences(identity, GenerateSBox(rand.Reader, 8), 1); err != ErrSBoxSize {
+		t.Fatalf("Got error %v, expected %v.", err, ErrSBoxSize)
+	}
+}
@@ -0,0 +1,105 @@
+package spn
+
+import (
+	"errors"
+	"strings"
+)
+
+// LayerType is the type of one layer of an SPN: either an S-box layer or an affine layer.
+type LayerType byte
+
+const (
+	Substitution LayerType = 'S'
+	Affine       LayerType = 'A'
+)
+
+// Structure is a sequence of layers, written in function composition notation. The rightmost layer is applied first,
+// so a cipher with structure ASAS first applies an S-box layer and last applies an affine layer.
+type Structure string
+
+const (
+	AS    Structure = "AS"
+	SA    Structure = "SA"
+	ASA   Structure = "ASA"
+	SAS   Structure = "SAS"
+	ASAS  Structure = "ASAS"
+	SASA  Structure = "SASA"
+	ASASA Structure = "ASASA"
+	SASAS Structure = "SASAS"
+)
+
+// ErrInvalidStructure is returned by ParseStructure when given an empty structure or one with unknown layer types.
+var ErrInvalidStructure = errors.New("spn: structure must be a non-empty sequence of S and A")
+
+// ParseStructure parses a string like "SASAS" into a structure. Case is ignored.
+func ParseStructure(in string) (Structure, error) {
+	structure := Structure(strings.ToUpper(in))
+	if !structure.Valid() {
+		return "", ErrInvalidStructure
+	}
+
+	return structure, nil
+}
+
+// String returns the structure in function composition notation.
+func (s Structure) String() string { return string(s) }
+
+// Valid returns true if the structure is non-empty and only contains S-box and affine layers.
+func (s Structure) Valid() bool {
+	if len(s) == 0 {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		if t := LayerType(s[i]); t != Substitution && t != Affine {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Layers returns the layer types of the structure in the order they're applied to the input. It panics if the
+// structure is invalid.
+func (s Structure) Layers() (out []LayerType) {
+	if !s.Valid() {
+		panic("Unknown SPN structure!")
+	}
+
+	for i := len(s) - 1; i >= 0; i-- {
+		out = append(out, LayerType(s[i]))
+	}
+
+	return
+}
+
+// Outer returns the type of the last layer applied to the input.
+func (s Structure) Outer() LayerType { return LayerType(s[0]) }
+
+// Inner returns the structure of everything except the last layer applied to the input.
+func (s Structure) Inner() Structure { return s[1:] }
+
+// Inverse returns the structure of the inverse cipher, which applies the same layers in the opposite order. For example,
+// the inverse of SASA is ASAS.
+func (s Structure) Inverse() Structure {
+	out := make([]byte, len(s))
+	for i := 0; i < len(s); i++ {
+		out[len(s)-1-i] = s[i]
+	}
+
+	return Structure(out)
+}
+
+// Reduce merges consecutive layers of the same type, which compose into a single layer of that type. For example, AAS
+// reduces to AS.
+func (s Structure) Reduce() Structure {
+	out := []byte{}
+
+	for i := 0; i < len(s); i++ {
+		if len(out) == 0 || out[len(out)-1] != s[i] {
+			out = append(out, s[i])
+		}
+	}
+
+	return Structure(out)
+}
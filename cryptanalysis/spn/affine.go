@@ -1,10 +1,17 @@
 package spn
 
 import (
-	"crypto/rand"
+	"bytes"
+	"context"
+	"io"
+	"sort"
 
 	"github.com/OpenWhiteBox/primitives/encoding"
 	"github.com/OpenWhiteBox/primitives/matrix"
+
+	"github.com/OpenWhiteBox/Generic/constructions/spn"
+	"github.com/OpenWhiteBox/Generic/internal/gf2"
+	"github.com/OpenWhiteBox/Generic/internal/random"
 )
 
 // findIntersections returns the incremental matrix containing only the rowspace that a set of given incremental
@@ -49,138 +56,366 @@ func findIntersection(aT, bT matrix.IncrementalMatrix) matrix.IncrementalMatrix
 	return out
 }
 
-// trivialSubspaces generates subspaces by fixing one input and letting the rest vary.
-func trivialSubspaces(cipher encoding.Block) (subspaces []matrix.IncrementalMatrix) {
-	for pos := 0; pos < 16; pos++ {
-		subspace := matrix.NewIncrementalMatrix(128)
+// SubspaceGenerator finds one subspace of the cipher's output space per S-box in its last S-box layer, where the S-boxes
+// are width bits wide. Each subspace must be the span of every S-box's output except one. It spreads its work across up
+// to workers goroutines, and returns a *StageError if it can't find the subspaces or ctx is done first.
+type SubspaceGenerator func(ctx context.Context, rand io.Reader, cipher encoding.Block, width, workers int) ([]matrix.IncrementalMatrix, error)
+
+// trivialSubspaces generates subspaces by fixing one input and letting the rest vary. Each input is handled by its own
+// worker.
+func (a *Attacker) trivialSubspaces(ctx context.Context, rand io.Reader, cipher encoding.Block, width, workers int) ([]matrix.IncrementalMatrix, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, &StageError{TrivialSubspaces, -1, 0, err}
+	}
 
-		for i := 0; i < 256 && subspace.Len() < 120; i++ {
+	sboxes := 128 / width
+	subspaces, attempts := make([]matrix.IncrementalMatrix, sboxes), make([]int, sboxes)
+
+	streams := make([]io.Reader, sboxes)
+	for pos := range streams {
+		streams[pos] = substream(rand)
+	}
+
+	parallel(workers, sboxes, func(pos int) {
+		subspaces[pos] = matrix.NewIncrementalMatrix(128)
+
+		for ; attempts[pos] < a.opts.TrivialAttempts && subspaces[pos].Len() < 128-width; attempts[pos]++ {
 			x, y := [16]byte{}, [16]byte{}
-			rand.Read(x[:])
-			rand.Read(y[:])
-			x[pos], y[pos] = 0x00, 0x00
+			random.ReadFull(streams[pos], x[:])
+			random.ReadFull(streams[pos], y[:])
+			gf2.SetChunk(x[:], pos*width, width, 0)
+			gf2.SetChunk(y[:], pos*width, width, 0)
 
 			x, y = cipher.Encode(x), cipher.Encode(y)
 
-			subspace.Add(matrix.Row(x[:]).Add(matrix.Row(y[:])))
+			subspaces[pos].Add(matrix.Row(x[:]).Add(matrix.Row(y[:])))
 		}
+	})
 
-		if subspace.Len() != 120 {
-			panic("Found incorrectly sized subspace!")
+	rank, total := 128, 0
+	for pos, subspace := range subspaces {
+		if subspace.Len() < rank {
+			rank = subspace.Len()
 		}
+		total += attempts[pos]
+	}
+	notify(ctx, Event{Kind: RankProgress, Stage: TrivialSubspaces, Layer: -1, Rank: rank, Target: 128 - width, Attempts: total})
 
-		subspaces = append(subspaces, subspace)
+	for pos, subspace := range subspaces {
+		if subspace.Len() != 128-width {
+			return nil, &StageError{TrivialSubspaces, -1, attempts[pos], ErrSubspaceSize}
+		}
 	}
 
-	return
+	return subspaces, nil
 }
 
-type nextFunc func(int, int, [16]byte, [16]byte) ([16]byte, [16]byte)
+// nextFunc generates the next set of plaintexts from the current one, in place, for an SPN with width-bit S-boxes. The
+// differences between the plaintexts must be kept the same, so that a collision in the cipher's internal state persists.
+type nextFunc func(rand io.Reader, width, iteration, marker int, points [][16]byte)
 
 // nextByAddition generates subsequent plaintexts by adding a random constant.
-func nextByAddition(iteration, marker int, x, y [16]byte) (X, Y [16]byte) {
-	copy(X[:], x[:])
-	copy(Y[:], y[:])
-
+func nextByAddition(rand io.Reader, width, iteration, marker int, points [][16]byte) {
 	c := [16]byte{}
-	rand.Read(c[:])
-
-	encoding.XOR(X[:], X[:], c[:])
-	encoding.XOR(Y[:], Y[:], c[:])
+	random.ReadFull(rand, c[:])
 
-	return X, Y
+	for i := range points {
+		encoding.XOR(points[i][:], points[i][:], c[:])
+	}
 }
 
-// nextByToggle generates subsequent plaintexts by toggling the value of a position.
-func nextByToggle(iteration, marker int, x, y [16]byte) (X, Y [16]byte) {
-	copy(X[:], x[:])
-	copy(Y[:], y[:])
+// nextByToggle generates subsequent plaintexts by toggling the value of a position. With 4-bit S-boxes, the differences
+// in the output would only be quadratic in the 8 bits of one position, which can't span the output space, so it toggles
+// two positions and randomizes the second.
+func nextByToggle(rand io.Reader, width, iteration, marker int, points [][16]byte) {
+	c := make([]byte, 8/width-1)
+	random.ReadFull(rand, c)
+
+	for i := range points {
+		points[i][marker%16] = byte(iteration)
+		for j, c_j := range c {
+			points[i][(marker+j+1)%16] = c_j
+		}
+	}
+}
 
-	X[marker%16], Y[marker%16] = byte(iteration), byte(iteration)
+// lowRankDetectionWith is a wrapper around lowRankDetection which injects the right next function
+func (a *Attacker) lowRankDetectionWith(next nextFunc) SubspaceGenerator {
+	return func(ctx context.Context, rand io.Reader, cipher encoding.Block, width, workers int) ([]matrix.IncrementalMatrix, error) {
+		return a.lowRankDetection(ctx, rand, cipher, width, workers, next)
+	}
+}
 
-	return
+// collisionGroup is the span of the subspaces that lowRankDetection found which are consistent with a collision in the
+// same S-box.
+type collisionGroup struct {
+	span    matrix.IncrementalMatrix
+	members int
 }
 
-// lowRankDetectionWith is a wrapper around lowRankDetection which injects the right next function
-func lowRankDetectionWith(next nextFunc) func(encoding.Block) []matrix.IncrementalMatrix {
-	return func(cipher encoding.Block) []matrix.IncrementalMatrix {
-		return lowRankDetection(cipher, next)
+// join adds subspace to the group if their span is at most max-dimensional, and returns whether it did.
+func (cg *collisionGroup) join(subspace matrix.IncrementalMatrix, max int) bool {
+	span := cg.span.Dup()
+
+	for _, row := range basisOf(subspace) {
+		span.Add(row)
+
+		if span.Len() > max {
+			return false
+		}
 	}
+
+	cg.span, cg.members = span, cg.members+1
+	return true
 }
 
-// lowRankDetection generates subspaces by choosing random pairs of inputs and checking if the linear span of their
-// output is the right size.
-func lowRankDetection(cipher encoding.Block, next nextFunc) (subspaces []matrix.IncrementalMatrix) {
-	for attempt := 0; attempt < 4000 && len(subspaces) < 16; attempt++ {
-		// Generate a random subspace.
-		x, y := [16]byte{}, [16]byte{}
-		rand.Read(x[:])
-		rand.Read(y[:])
+// essential returns the positions of the candidates whose annihilators aren't contained in the span of the others'.
+func essential(annihilators []matrix.IncrementalMatrix) (out []int) {
+	for i := range annihilators {
+		others := matrix.NewIncrementalMatrix(128)
+		for j, ann := range annihilators {
+			if j != i {
+				for _, row := range basisOf(ann) {
+					others.Add(row)
+				}
+			}
+		}
 
-		subspace := matrix.NewIncrementalMatrix(128)
+		all := others.Dup()
+		for _, row := range basisOf(annihilators[i]) {
+			all.Add(row)
+		}
 
-		for i := 0; i < 129 && subspace.Len() <= 120; i++ {
-			x, y = next(i, attempt, x, y)
-			X, Y := cipher.Encode(x), cipher.Encode(y)
+		if all.Len() > others.Len() {
+			out = append(out, i)
+		}
+	}
 
-			subspace.Add(matrix.Row(X[:]).Add(matrix.Row(Y[:])))
+	return
+}
+
+// lowRankDetection generates subspaces by choosing random sets of inputs and checking if the linear span of the
+// differences in their output is small enough that some S-box's output never changes.
+//
+// A difference between two inputs often fails to span an S-box's whole output space, especially for 4-bit S-boxes, so
+// a small span doesn't prove a collision. Subspaces that are small enough are grouped with the others they could share a
+// collision with, and a group is only kept as a candidate once two or more of them span every S-box's output except one.
+// Narrower S-boxes use more inputs, so that the differences have to collide on 8 bits of the internal state between
+// them. It makes up to LowRankAttempts attempts per S-box. Attempts are run by workers in batches, and each reads from
+// its own substream of rand, so the result only depends on rand and the number of workers.
+//
+// Some candidates come from near-collisions instead: an S-box with an affine component, or with a component whose
+// derivative is constant in the direction of the input difference, keeps that component of its output difference
+// constant without colliding. Between several S-boxes, that can look like a collision in one. The annihilators of the
+// true subspaces are independent and span the whole output space, while the annihilator of a near-collision lies in the
+// span of the true ones for the S-boxes it involves, so once every true subspace is found, they're the only candidates
+// that the others don't cover. The candidates are kept until that happens.
+//
+// When enough S-boxes have affine components, near-collisions are so common that they cover the true subspaces too. It
+// gives up with ErrNearCollisions once it has more than twice as many candidates as S-boxes, since at most one per S-box
+// can be true, and with ErrNotEnoughSubspaces if the attempts run out first. With random 4-bit S-boxes, a few in a
+// hundred ASA ciphers fail this way, all of them with at least two S-boxes that have affine components. Toggling inputs
+// changes the differences between samples, so near-collisions don't repeat and ASAS isn't affected, and 8-bit S-boxes
+// essentially never have affine components.
+func (a *Attacker) lowRankDetection(ctx context.Context, rand io.Reader, cipher encoding.Block, width, workers int, next nextFunc) (subspaces []matrix.IncrementalMatrix, err error) {
+	sboxes := 128 / width
+	groups := []collisionGroup{}
+	candidates, annihilators := []matrix.IncrementalMatrix{}, []matrix.IncrementalMatrix{}
+
+	attempts, attempt := a.opts.LowRankAttempts*sboxes, 0
+	for attempt < attempts && len(subspaces) < sboxes {
+		if err := ctx.Err(); err != nil {
+			return nil, &StageError{LowRankDetection, -1, attempt, err}
 		}
 
-		// Discard it if it's the wrong size.
-		if subspace.Len() != 120 {
-			continue
+		batch := make([]matrix.IncrementalMatrix, batchSize(workers, attempts-attempt))
+		streams := make([]io.Reader, len(batch))
+		for i := range streams {
+			streams[i] = substream(rand)
 		}
 
-		// Discard it if it overlaps too much with what we already have.
-		dup := false
-		for _, cand := range subspaces {
-			intersection := findIntersection(subspace, cand)
+		parallel(workers, len(batch), func(i int) {
+			batch[i] = a.lowRankCandidate(streams[i], cipher, width, attempt+i, next)
+		})
+
+		for i := 0; i < len(batch) && len(subspaces) < sboxes; i++ {
+			attempt++
+			subspace := batch[i]
 
-			if intersection.Len() != 112 {
-				dup = true
-				break
+			// Discard it if it's the wrong size.
+			if subspace.Len() > 128-width || subspace.Len() <= 128-2*width {
+				continue
 			}
+
+			// Add it to every group it's consistent with, or start a new one if there aren't any.
+			joined := false
+			for j := 0; j < len(groups) && len(subspaces) < sboxes; j++ {
+				if !groups[j].join(subspace, 128-width) {
+					continue
+				}
+				joined = true
+
+				if groups[j].members < 2 || groups[j].span.Len() != 128-width {
+					continue
+				}
+
+				// The group is complete, so take it out and keep its span as a candidate unless we already have it.
+				span := groups[j].span
+				groups = append(groups[:j], groups[j+1:]...)
+				j--
+
+				repeat := false
+				for _, cand := range candidates {
+					repeat = repeat || findIntersection(span, cand).Len() == 128-width
+				}
+
+				if repeat {
+					notify(ctx, Event{Kind: SubspaceRejected, Stage: LowRankDetection, Layer: -1, Rank: len(subspaces), Target: sboxes, Attempts: attempt})
+					continue
+				}
+
+				candidates, annihilators = append(candidates, span), append(annihilators, annihilator(span))
+				if len(candidates) > 2*sboxes {
+					return nil, &StageError{LowRankDetection, -1, attempt, ErrNearCollisions}
+				}
+				kept := essential(annihilators)
+
+				total := matrix.NewIncrementalMatrix(128)
+				for _, k := range kept {
+					for _, row := range basisOf(annihilators[k]) {
+						total.Add(row)
+					}
+				}
+
+				if len(kept) == sboxes && total.Len() == 128 {
+					for _, k := range kept {
+						subspaces = append(subspaces, candidates[k])
+					}
+				}
+				notify(ctx, Event{Kind: SubspaceAccepted, Stage: LowRankDetection, Layer: -1, Rank: len(kept), Target: sboxes, Attempts: attempt})
+			}
+
+			if !joined {
+				groups = append(groups, collisionGroup{span: subspace, members: 1})
+			}
+		}
+	}
+
+	if len(subspaces) < sboxes {
+		return nil, &StageError{LowRankDetection, -1, attempt, ErrNotEnoughSubspaces}
+	}
+
+	sortSubspaces(subspaces)
+	return
+}
+
+// lowRankCandidate chooses a random set of inputs and returns the span of the differences in the cipher's output as they
+// move along next, stopping once it's too big to be a collision.
+func (a *Attacker) lowRankCandidate(rand io.Reader, cipher encoding.Block, width, attempt int, next nextFunc) matrix.IncrementalMatrix {
+	points := make([][16]byte, 1+8/width)
+	for i := range points {
+		random.ReadFull(rand, points[i][:])
+	}
+
+	subspace := matrix.NewIncrementalMatrix(128)
+
+	for i := 0; i < a.opts.LowRankSamples && subspace.Len() <= 128-width; i++ {
+		next(rand, width, i, attempt, points)
+		X := cipher.Encode(points[0])
+
+		for _, y := range points[1:] {
+			Y := cipher.Encode(y)
+			subspace.Add(matrix.Row(X[:]).Add(matrix.Row(Y[:])))
 		}
+	}
+
+	return subspace
+}
+
+// canonicalBasis returns the reduced row echelon form of the basis of im, which only depends on the subspace it spans.
+func canonicalBasis(im matrix.IncrementalMatrix) []matrix.Row {
+	if im.Len() == 0 {
+		return nil
+	}
 
-		if dup {
-			continue
+	return gf2.ReducedRows(basisOf(im))
+}
+
+// sortSubspaces puts subspaces in an order that only depends on what they span, for generators whose subspaces can come
+// out in any order.
+func sortSubspaces(subspaces []matrix.IncrementalMatrix) {
+	keys := make([][]byte, len(subspaces))
+	for i, subspace := range subspaces {
+		for _, row := range canonicalBasis(subspace) {
+			keys[i] = append(keys[i], row...)
 		}
+	}
 
-		// Not discarded, so keep it.
-		subspaces = append(subspaces, subspace)
+	sorted := append([]matrix.IncrementalMatrix{}, subspaces...)
+	order := make([]int, len(subspaces))
+	for i := range order {
+		order[i] = i
 	}
+	sort.Slice(order, func(i, j int) bool { return bytes.Compare(keys[order[i]], keys[order[j]]) < 0 })
 
-	if len(subspaces) < 16 {
-		panic("Failed to recover enough subspaces.")
+	for i, j := range order {
+		subspaces[i] = sorted[j]
 	}
+}
 
-	return
+// RecoverAffine is the attacker's RecoverAffine, with the generator's work spread across up to workers goroutines.
+func RecoverAffine(ctx context.Context, rand io.Reader, cipher encoding.Block, width, workers int, generator SubspaceGenerator) (last encoding.BlockAffine, rest encoding.Block, err error) {
+	return NewAttacker(Options{Workers: workers}).RecoverAffine(ctx, rand, cipher, width, generator)
 }
 
 // RecoverAffine finds inputs that cause the internal state of the cipher to collide with something like Low Rank
-// Detection and uses them to remove the trailing affine layer.
-func RecoverAffine(cipher encoding.Block, generator func(encoding.Block) []matrix.IncrementalMatrix) (last encoding.BlockAffine, rest encoding.Block) {
-	subspaces := generator(cipher)
+// Detection and uses them to remove the trailing affine layer. The S-boxes before it are width bits wide. Random choices
+// are read from rand, and the generator spreads its work across up to the attacker's workers goroutines. It returns the
+// generator's error if it fails or ctx is done first, and ErrBudgetExceeded if cipher queries an Oracle whose budget
+// runs out.
+//
+// The trailing layer is only defined up to an invertible affine map on each S-box's output, which can be moved between it
+// and the rest of the cipher. It's returned in a normalized form: the columns for each S-box are the reduced row echelon
+// basis of that S-box's output space, and the constant is the cipher's output on zero, so rest maps zero to zero. Given
+// the same subspaces, every key that differs only in that freedom gives the same last layer. ReparameterizeAffine moves
+// to any other choice.
+func (a *Attacker) RecoverAffine(ctx context.Context, rand io.Reader, cipher encoding.Block, width int, generator SubspaceGenerator) (last encoding.BlockAffine, rest encoding.Block, err error) {
+	defer recoverBudget(&err)
+
+	subspaces, err := generator(ctx, rand, cipher, width, a.opts.Workers)
+	if err != nil {
+		return last, nil, err
+	}
+	sboxes := 128 / width
 
-	// Recover span of each column by intersecting 15 others
+	// Recover span of each column by intersecting all the others
 	m := matrix.Matrix{}
 
-	for excluded := 0; excluded < 16; excluded++ {
+	for excluded := 0; excluded < sboxes; excluded++ {
 		remaining := []matrix.IncrementalMatrix{}
 
-		for i := 0; i < 16; i++ {
+		for i := 0; i < sboxes; i++ {
 			if i != excluded {
 				remaining = append(remaining, subspaces[i])
 			}
 		}
 
-		intersection := findIntersections(remaining)
-
-		for bit := uint(0); bit < 8; bit++ {
-			m = append(m, intersection.Row(1<<bit))
-		}
+		m = append(m, canonicalBasis(findIntersections(remaining))...)
 	}
 
-	last = encoding.NewBlockAffine(m.Transpose(), [16]byte{})
-	return last, encoding.ComposedBlocks{cipher, encoding.InverseBlock{last}}
+	last = encoding.NewBlockAffine(m.Transpose(), cipher.Encode([16]byte{}))
+	return last, encoding.ComposedBlocks{cipher, encoding.InverseBlock{last}}, nil
+}
+
+// ReparameterizeAffine moves the trailing affine layer and the rest of a cipher recovered by RecoverAffine to another
+// point in their equivalence class: maps[i] is applied to the output of the ith S-box in rest, and undone at the start
+// of last. The cipher they compute together doesn't change.
+func ReparameterizeAffine(last encoding.BlockAffine, rest encoding.Block, maps []spn.AffineMap) (encoding.BlockAffine, encoding.Block) {
+	chunks := spn.ChunkLayer(maps).Inverse()
+
+	constant := [16]byte{}
+	copy(constant[:], chunks.Constant)
+
+	last = encoding.NewBlockAffine(last.BlockLinear.Forwards.Compose(chunks.Forwards), last.Encode(constant))
+	return last, encoding.ComposedBlocks{rest, encoding.InverseBlock{spn.ToBlock(chunks)}}
 }
@@ -0,0 +1,228 @@
+package spn
+
+import (
+	"context"
+	"io"
+
+	"github.com/OpenWhiteBox/Generic/constructions/spn"
+)
+
+// Options trade the number of queries an attack makes against how likely it is to succeed. Fields which are zero take
+// their value from DefaultOptions.
+type Options struct {
+	// Workers is the number of goroutines each stage is spread across.
+	Workers int
+
+	// TrivialAttempts is the number of pairs of plaintexts trivialSubspaces tries for each S-box.
+	TrivialAttempts int
+
+	// LowRankAttempts is the number of sets of plaintexts low rank detection tries for each S-box, and LowRankSamples is
+	// the number of times each set is moved along before it's given up on.
+	LowRankAttempts int
+	LowRankSamples  int
+
+	// QuadraticCubes is the number of cubes quadraticSubspaces sums over for each pair of output bits, and
+	// QuadraticSplits is the number of random forms it tries to split the output space with.
+	QuadraticCubes  int
+	QuadraticSplits int
+
+	// CubeAttempts is the number of sets of plaintexts the cube attack tries. CubeNullity is the largest nullspace the
+	// relations on each S-box may have before the S-box is searched for. If it's zero, it's one more than the width of
+	// the S-boxes, so 247 relations are needed for each 8-bit S-box.
+	CubeAttempts int
+	CubeNullity  int
+
+	// SBoxCandidates is the number of subspaces of the relations' solutions the cube attack searches for each S-box
+	// before giving up. A larger CubeNullity needs more, and makes it likelier that more than one S-box is consistent
+	// with the relations, which fails with ErrAmbiguousSBox.
+	SBoxCandidates int
+
+	// Generators overrides the plaintexts the cube attack uses to peel the last layer of each reduced structure.
+	Generators map[spn.Structure]Generator
+
+	// IdentificationTrials is the number of times IdentifyStructure tests each property. A cipher without the property
+	// passes each trial with probability at most 1/2.
+	IdentificationTrials int
+}
+
+// DefaultOptions are the options the package-level functions attack with.
+var DefaultOptions = Options{
+	Workers: 1,
+
+	TrivialAttempts: 256,
+
+	LowRankAttempts: 250,
+	LowRankSamples:  129,
+
+	QuadraticCubes:  2,
+	QuadraticSplits: 256,
+
+	CubeAttempts:   2000,
+	SBoxCandidates: 1 << 20,
+
+	IdentificationTrials: 16,
+}
+
+// Attacker runs attacks with a fixed set of options. It can be used by several goroutines at once.
+type Attacker struct {
+	opts Options
+}
+
+// NewAttacker returns an Attacker with the given options.
+func NewAttacker(opts Options) *Attacker {
+	orDefault := func(x *int, def int) {
+		if *x == 0 {
+			*x = def
+		}
+	}
+
+	orDefault(&opts.Workers, DefaultOptions.Workers)
+	orDefault(&opts.TrivialAttempts, DefaultOptions.TrivialAttempts)
+	orDefault(&opts.LowRankAttempts, DefaultOptions.LowRankAttempts)
+	orDefault(&opts.LowRankSamples, DefaultOptions.LowRankSamples)
+	orDefault(&opts.QuadraticCubes, DefaultOptions.QuadraticCubes)
+	orDefault(&opts.QuadraticSplits, DefaultOptions.QuadraticSplits)
+	orDefault(&opts.CubeAttempts, DefaultOptions.CubeAttempts)
+	orDefault(&opts.CubeNullity, DefaultOptions.CubeNullity)
+	orDefault(&opts.SBoxCandidates, DefaultOptions.SBoxCandidates)
+	orDefault(&opts.IdentificationTrials, DefaultOptions.IdentificationTrials)
+
+	return &Attacker{opts}
+}
+
+// Options returns the attacker's options, with defaults filled in.
+func (a *Attacker) Options() Options {
+	return a.opts
+}
+
+// nullity returns the largest nullspace the cube attack accepts for width-bit S-boxes.
+func (a *Attacker) nullity(width int) int {
+	if a.opts.CubeNullity == 0 {
+		return width + 1
+	}
+
+	return a.opts.CubeNullity
+}
+
+// cubeGenerator returns the plaintexts the cube attack uses to peel the last layer of structure, along with the name
+// that events give them.
+func (a *Attacker) cubeGenerator(structure spn.Structure, width int) (string, Generator) {
+	if generator, ok := a.opts.Generators[structure]; ok {
+		return "custom plaintexts", generator
+	}
+
+	switch structure {
+	case spn.SA:
+		return "balanced plaintexts", BalancedPlaintexts(4)
+	case spn.SAS:
+		return "dual plaintexts", DualPlaintexts(4)
+	case spn.SASA, spn.SASAS:
+		return "permutation plaintexts", PermutationPlaintexts(1<<uint(width), width)
+	default:
+		// The input to the last S-box layer of SASASA has degree at most (width-1)^2, so it sums to zero over larger
+		// cubes. This is practical for 4-bit S-boxes, but not for 8-bit S-boxes, which supported rejects.
+		return "cube plaintexts", CubePlaintexts(cubeDimension(width))
+	}
+}
+
+// DecomposeSPN is DecomposeSPNWithContext with the attacker's options.
+func (a *Attacker) DecomposeSPN(ctx context.Context, rand io.Reader, constr Construction, structure spn.Structure, params spn.Params) (out spn.Construction, err error) {
+	if params.BlockSize != 16 || (params.SBoxSize != 4 && params.SBoxSize != 8) {
+		return nil, ErrUnsupportedParams
+	} else if err := a.supported(structure, params.SBoxSize, false); err != nil {
+		return nil, err
+	}
+
+	err = attack(ctx, constr, func(ctx context.Context, oracle *Oracle) (err error) {
+		out, err = a.decomposeSPN(ctx, rand, oracle, Encoding{oracle}, structure, params.SBoxSize)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// DecomposeInverseSPN is DecomposeInverseSPNWithContext with the attacker's options.
+func (a *Attacker) DecomposeInverseSPN(ctx context.Context, rand io.Reader, constr Decrypter, structure spn.Structure, params spn.Params) (spn.Construction, error) {
+	return a.decomposeInverseSPN(ctx, rand, Decryption{constr}, structure, params)
+}
+
+// decomposeInverseSPN decomposes inverse, the inverse of a cipher with the given structure, and inverts the result.
+func (a *Attacker) decomposeInverseSPN(ctx context.Context, rand io.Reader, inverse Construction, structure spn.Structure, params spn.Params) (spn.Construction, error) {
+	out, err := a.DecomposeSPN(ctx, rand, inverse, structure.Inverse(), params)
+	if err != nil {
+		return nil, err
+	}
+
+	return invert(out), nil
+}
+
+// DecomposeTwoSidedSPN is DecomposeTwoSidedSPNWithContext with the attacker's options.
+//
+// With 4-bit S-boxes, it also breaks ASASAS by first peeling its leading S-box layer off in the decryption direction.
+// With 8-bit S-boxes, that takes a cube attack over 2^50 plaintexts, so like ASASA, ASASAS fails with
+// ErrUnsupportedParams before making any queries.
+func (a *Attacker) DecomposeTwoSidedSPN(ctx context.Context, rand io.Reader, constr Cipher, structure spn.Structure, params spn.Params) (out spn.Construction, err error) {
+	if params.BlockSize != 16 || (params.SBoxSize != 4 && params.SBoxSize != 8) {
+		return nil, ErrUnsupportedParams
+	} else if err := a.supported(structure, params.SBoxSize, true); err != nil {
+		return nil, err
+	}
+
+	err = attack(ctx, constr, func(ctx context.Context, oracle *Oracle) (err error) {
+		out, err = a.decomposeTwoSidedSPN(ctx, rand, oracle, Encoding{oracle}, structure.Reduce(), params.SBoxSize, 0)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// IdentifyStructure is the package-level IdentifyStructure with the attacker's options. ctx is only used to report
+// progress.
+func (a *Attacker) IdentifyStructure(ctx context.Context, rand io.Reader, constr Construction, params spn.Params) (id Identification, err error) {
+	if params.BlockSize != 16 || (params.SBoxSize != 4 && params.SBoxSize != 8) {
+		return id, ErrUnsupportedParams
+	}
+
+	err = attack(ctx, constr, func(ctx context.Context, oracle *Oracle) error {
+		beginStage(ctx, oracle, StructureIdentification, -1, "")
+		id = identifyStructure(rand, Encoding{oracle}, params.SBoxSize, a.opts.IdentificationTrials)
+		endStage(ctx, oracle, nil)
+
+		return nil
+	})
+
+	return id, err
+}
+
+// DecomposeUnknownSPN is DecomposeUnknownSPNWithContext with the attacker's options.
+func (a *Attacker) DecomposeUnknownSPN(ctx context.Context, rand io.Reader, constr Construction, params spn.Params) (out spn.Construction, id Identification, err error) {
+	if params.BlockSize != 16 || (params.SBoxSize != 4 && params.SBoxSize != 8) {
+		return nil, id, ErrUnsupportedParams
+	}
+
+	err = attack(ctx, constr, func(ctx context.Context, oracle *Oracle) (err error) {
+		beginStage(ctx, oracle, StructureIdentification, -1, "")
+		id = identifyStructure(rand, Encoding{oracle}, params.SBoxSize, a.opts.IdentificationTrials)
+		endStage(ctx, oracle, nil)
+
+		if len(id.Candidates) > 1 {
+			return ErrAmbiguousStructure
+		} else if err := a.supported(id.Structure, params.SBoxSize, false); err != nil {
+			return err
+		}
+
+		out, err = a.decomposeSPN(ctx, rand, oracle, Encoding{oracle}, id.Structure, params.SBoxSize)
+		return err
+	})
+	if err != nil {
+		out = nil
+	}
+
+	return out, id, err
+}
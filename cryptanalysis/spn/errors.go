@@ -0,0 +1,72 @@
+package spn
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrUnknownStructure is returned when no attack on a structure is known.
+	ErrUnknownStructure = errors.New("spn: no attack on this structure is known")
+	// ErrUnsupportedParams is returned when the cryptanalysis doesn't support a construction's dimensions: anything but
+	// 128-bit blocks with 4- or 8-bit S-boxes, or a structure whose attack is impractical with those S-boxes.
+	ErrUnsupportedParams = errors.New("spn: unsupported SPN dimensions")
+	// ErrSubspaceSize is returned when a subspace of the output space has the wrong dimension.
+	ErrSubspaceSize = errors.New("spn: found incorrectly sized subspace")
+	// ErrNotEnoughSubspaces is returned when too few subspaces of the output space are found to split it into S-boxes.
+	ErrNotEnoughSubspaces = errors.New("spn: failed to recover enough subspaces")
+	// ErrNearCollisions is returned when low rank detection finds more than twice as many candidate subspaces as there
+	// are S-boxes, so that most of them must have come from near-collisions rather than collisions.
+	ErrNearCollisions = errors.New("spn: near-collisions hid the subspaces of the output space")
+	// ErrNotEnoughRelations is returned when the cube attack doesn't find enough linear relations in the S-boxes.
+	ErrNotEnoughRelations = errors.New("spn: cube attack failed to find enough linear relations in the S-boxes")
+	// ErrNoPermutation is returned when no S-box is consistent with the relations the cube attack found.
+	ErrNoPermutation = errors.New("spn: no S-box is consistent with the relations")
+	// ErrAmbiguousSBox is returned when more than one S-box is consistent with the relations the cube attack found.
+	ErrAmbiguousSBox = errors.New("spn: more than one S-box is consistent with the relations")
+	// ErrTooManyCandidates is returned when there are too many candidates for an S-box to search.
+	ErrTooManyCandidates = errors.New("spn: too many candidates for an S-box to search")
+	// ErrNotEnoughForms is returned when too few quadratic forms vanish on every cube.
+	ErrNotEnoughForms = errors.New("spn: failed to find enough vanishing quadratic forms")
+	// ErrAffineComponents is returned when the last S-box layer of an ASASA cipher has more than one affine component.
+	ErrAffineComponents = errors.New("spn: too many affine components in the last S-box layer")
+	// ErrSplit is returned when the vanishing quadratic forms don't split the output space into S-boxes.
+	ErrSplit = errors.New("spn: failed to split the output space into S-boxes")
+	// ErrNoDecomposition is returned when no candidate for a layer leads to a decomposition of the rest of the cipher.
+	ErrNoDecomposition = errors.New("spn: no decomposition found")
+	// ErrAmbiguousStructure is returned when more than one structure is consistent with the identification tests.
+	ErrAmbiguousStructure = errors.New("spn: structure is ambiguous")
+	// ErrBudgetExceeded is returned when a decomposition needs more queries than an Oracle's budget allows.
+	ErrBudgetExceeded = errors.New("spn: query budget exceeded")
+)
+
+// Stage is a step of an attack which recovers one layer of a construction.
+type Stage string
+
+const (
+	AffineDecomposition Stage = "affine decomposition"
+	SBoxDecomposition   Stage = "S-box decomposition"
+	TrivialSubspaces    Stage = "trivial subspaces"
+	LowRankDetection    Stage = "low rank detection"
+	QuadraticSubspaces  Stage = "quadratic subspaces"
+	CubeAttack          Stage = "cube attack"
+
+	StructureIdentification Stage = "structure identification"
+)
+
+// StageError records which stage of an attack failed, which layer it was recovering, and how many attempts it made.
+// Layers are counted in the order they're applied to the input of the reduced structure. Layer is -1 if the stage was
+// run on its own, rather than as part of a decomposition. Attempts is zero if the stage ran out of queries.
+type StageError struct {
+	Stage    Stage
+	Layer    int
+	Attempts int
+	Err      error
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("%v (stage %v, layer %v, %v attempts)", e.Err, e.Stage, e.Layer, e.Attempts)
+}
+
+// Unwrap returns the underlying error, so that errors.Is(err, ErrNotEnoughRelations) and the like work.
+func (e *StageError) Unwrap() error { return e.Err }
@@ -1,22 +1,26 @@
 package spn
 
 import (
-	"crypto/rand"
+	"io"
 
 	"github.com/OpenWhiteBox/primitives/encoding"
+
+	"github.com/OpenWhiteBox/Generic/internal/gf2"
+	"github.com/OpenWhiteBox/Generic/internal/random"
 )
 
-type Generator func() [][16]byte
+// Generator returns a set of plaintexts, making any random choices with rand.
+type Generator func(rand io.Reader) [][16]byte
 
 // BalancedPlaintexts returns a generator for balanced sets of n plaintexts. Balanced, meaning the plaintexts sum to
 // zero.
 func BalancedPlaintexts(n int) Generator {
-	return func() (out [][16]byte) {
+	return func(rand io.Reader) (out [][16]byte) {
 		master := [16]byte{}
 
 		for i := 0; i < n-1; i++ {
 			pt := [16]byte{}
-			rand.Read(pt[:])
+			random.ReadFull(rand, pt[:])
 
 			encoding.XOR(master[:], master[:], pt[:])
 
@@ -32,10 +36,10 @@ func BalancedPlaintexts(n int) Generator {
 // DualPlaintexts returns a generator for dual sets of n plaintexts. Dual, meaning that the i^th position of the
 // plaintexts either takes every value once or some subset of values an even number of times each.
 func DualPlaintexts(n int) Generator {
-	return func() (out [][16]byte) {
+	return func(rand io.Reader) (out [][16]byte) {
 		for i := 0; i < n/2; i++ {
 			pt := [16]byte{}
-			rand.Read(pt[:])
+			random.ReadFull(rand, pt[:])
 
 			out = append(out, pt)
 		}
@@ -56,15 +60,16 @@ func DualPlaintexts(n int) Generator {
 }
 
 // PermutationPlaintexts returns a generator for sets of n plaintexts which are constant at all except one randomly
-// chosen position, which takes as many values as possible.
-func PermutationPlaintexts(n int) Generator {
-	return func() (out [][16]byte) {
+// chosen width-bit position, which takes as many values as possible.
+func PermutationPlaintexts(n, width int) Generator {
+	return func(rand io.Reader) (out [][16]byte) {
 		master := [16]byte{}
-		rand.Read(master[:])
+		random.ReadFull(rand, master[:])
+		pos := int(master[0]) % (128 / width)
 
 		for i := 0; i < n; i++ {
 			pt := [16]byte{}
-			pt[master[0]&0x0f] = byte(i)
+			gf2.SetChunk(pt[:], pos*width, width, uint16(i%(1<<uint(width))))
 
 			encoding.XOR(pt[:], pt[:], master[:])
 
@@ -74,3 +79,29 @@ func PermutationPlaintexts(n int) Generator {
 		return out
 	}
 }
+
+// CubePlaintexts returns a generator for random affine subspaces of plaintexts of dimension dim. Any function of degree
+// less than dim sums to zero over them.
+func CubePlaintexts(dim int) Generator {
+	return func(rand io.Reader) (out [][16]byte) {
+		basis := make([][16]byte, dim+1)
+		for i := range basis {
+			random.ReadFull(rand, basis[i][:])
+		}
+
+		out = make([][16]byte, 1<<uint(dim))
+		out[0] = basis[dim]
+
+		for i := 1; i < len(out); i++ {
+			// Add the basis vector of i's lowest bit to the point without it.
+			bit := 0
+			for (i>>uint(bit))&1 == 0 {
+				bit++
+			}
+
+			encoding.XOR(out[i][:], out[i&(i-1)][:], basis[bit][:])
+		}
+
+		return out
+	}
+}
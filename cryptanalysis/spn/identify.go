@@ -0,0 +1,230 @@
+package spn
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+
+	"github.com/OpenWhiteBox/primitives/encoding"
+	"github.com/OpenWhiteBox/primitives/matrix"
+
+	"github.com/OpenWhiteBox/Generic/constructions/spn"
+	"github.com/OpenWhiteBox/Generic/internal/gf2"
+	"github.com/OpenWhiteBox/Generic/internal/random"
+)
+
+// identifiable are the reduced structures that IdentifyStructure can recognize, shortest first.
+var identifiable = []spn.Structure{
+	"A", "S", spn.AS, spn.SA, spn.ASA, spn.SAS, spn.ASAS, spn.SASA, spn.ASASA, spn.SASAS, "ASASAS", "SASASA",
+}
+
+// Identification is the structure of an SPN, as identified by IdentifyStructure.
+type Identification struct {
+	// Structure is the most likely reduced structure.
+	Structure spn.Structure
+	// Candidates are every reduced structure consistent with the tests, shortest first.
+	Candidates []spn.Structure
+	// Confidence is a lower bound on the probability that Structure is right, assuming that every candidate is equally
+	// likely and that the cipher's layers are random.
+	Confidence float64
+}
+
+// distinguisher tests a cipher for a property with the given number of trials, and returns true if it held on every
+// trial.
+type distinguisher func(rand io.Reader, cipher encoding.Block, trials int) bool
+
+// identificationTest is a distinguisher and the structures that have its property.
+type identificationTest struct {
+	test distinguisher
+	has  map[spn.Structure]bool
+}
+
+// structureSet returns a set containing the given structures.
+func structureSet(structures ...spn.Structure) map[spn.Structure]bool {
+	out := map[spn.Structure]bool{}
+	for _, structure := range structures {
+		out[structure] = true
+	}
+
+	return out
+}
+
+// identificationTests returns the tests that tell structures with width-bit S-boxes apart, cheapest first. The
+// properties follow from multiset calculus: an S-box layer has degree width-1 and maps positions that take every value,
+// or every value they take an even number of times, to positions that do the same, while an affine layer maps them to
+// positions which sum to zero.
+func identificationTests(width int) []identificationTest {
+	oneLayer, twoLayers := CubePlaintexts(width), CubePlaintexts((width-1)*(width-1)+1)
+	permutations := PermutationPlaintexts(1<<uint(width), width)
+
+	tests := []identificationTest{
+		{cubeSums(BalancedPlaintexts(4)), structureSet("A")},
+		{fixedChunks(width), structureSet("S")},
+		{fixedChunkSpans(width), structureSet("A", "S", spn.AS)},
+		{cubeSums(oneLayer), structureSet("A", "S", spn.AS, spn.SA, spn.ASA)},
+		{lastSBoxRelations(width, BalancedPlaintexts(4)), structureSet("S", spn.SA)},
+		{lastSBoxRelations(width, DualPlaintexts(4)), structureSet("S", spn.SA, spn.SAS)},
+		{cubeSums(permutations), structureSet("A", "S", spn.AS, spn.SA, spn.ASA, spn.SAS, spn.ASAS)},
+		{lastSBoxRelations(width, oneLayer), structureSet("S", spn.SA, spn.SAS, spn.SASA)},
+		{lastSBoxRelations(width, permutations), structureSet("S", spn.SA, spn.SAS, spn.SASA, spn.SASAS)},
+	}
+
+	// Cubes over two S-box layers have 2^50 elements with 8-bit S-boxes.
+	if width == 4 {
+		tests = append(tests, []identificationTest{
+			{cubeSums(twoLayers), structureSet("A", "S", spn.AS, spn.SA, spn.ASA, spn.SAS, spn.ASAS, spn.SASA, spn.ASASA)},
+			{lastSBoxRelations(width, twoLayers), structureSet("S", spn.SA, spn.SAS, spn.SASA, spn.SASAS, "SASASA")},
+		}...)
+	}
+
+	return tests
+}
+
+// cubeSums tests whether the ciphertexts of every set of plaintexts from generator sum to zero.
+func cubeSums(generator Generator) distinguisher {
+	return func(rand io.Reader, cipher encoding.Block, trials int) bool {
+		for i := 0; i < trials; i++ {
+			sum := [16]byte{}
+
+			for _, pt := range generator(rand) {
+				ct := cipher.Encode(pt)
+				encoding.XOR(sum[:], sum[:], ct[:])
+			}
+
+			if sum != [16]byte{} {
+				return false
+			}
+		}
+
+		return true
+	}
+}
+
+// fixedChunks tests whether fixing one width-bit position of the input fixes the same position of the output.
+func fixedChunks(width int) distinguisher {
+	return func(rand io.Reader, cipher encoding.Block, trials int) bool {
+		for i := 0; i < trials; i++ {
+			x, y := [16]byte{}, [16]byte{}
+			random.ReadFull(rand, x[:])
+			random.ReadFull(rand, y[:])
+
+			pos := int(x[0]) % (128 / width)
+			gf2.SetChunk(y[:], pos*width, width, gf2.GetChunk(x[:], pos*width, width))
+
+			cx, cy := cipher.Encode(x), cipher.Encode(y)
+			if gf2.GetChunk(cx[:], pos*width, width) != gf2.GetChunk(cy[:], pos*width, width) {
+				return false
+			}
+		}
+
+		return true
+	}
+}
+
+// fixedChunkSpans tests whether fixing one width-bit position of the input restricts the output to a subspace of
+// dimension 128-width, like trivialSubspaces expects.
+func fixedChunkSpans(width int) distinguisher {
+	return func(rand io.Reader, cipher encoding.Block, trials int) bool {
+		subspace := matrix.NewIncrementalMatrix(128)
+
+		for i := 0; i < 128-width+trials; i++ {
+			x, y := [16]byte{}, [16]byte{}
+			random.ReadFull(rand, x[:])
+			random.ReadFull(rand, y[:])
+			gf2.SetChunk(x[:], 0, width, 0)
+			gf2.SetChunk(y[:], 0, width, 0)
+
+			x, y = cipher.Encode(x), cipher.Encode(y)
+			subspace.Add(matrix.Row(x[:]).Add(matrix.Row(y[:])))
+		}
+
+		return subspace.Len() <= 128-width
+	}
+}
+
+// lastSBoxRelations tests whether the cube attack with plaintexts from generator finds the relations it would if the
+// cipher ended with a layer of width-bit S-boxes whose input sums to zero over every set.
+func lastSBoxRelations(width int, generator Generator) distinguisher {
+	return func(rand io.Reader, cipher encoding.Block, trials int) bool {
+		ims := newIncrementalMatrices(128/width, 1<<uint(width))
+
+		for i := 0; i < 1<<uint(width)+trials; i++ {
+			addRelations(ims, cipher, width, generator(rand))
+		}
+
+		for _, im := range ims {
+			if im.Len() > 1<<uint(width)-(width+1) {
+				return false
+			}
+		}
+
+		return true
+	}
+}
+
+// identifyStructure runs the identification tests on cipher, trials times each, skipping the ones that wouldn't rule out
+// any remaining candidate.
+func identifyStructure(rand io.Reader, cipher encoding.Block, width, trials int) Identification {
+	candidates := identifiable
+	failure := 0.0
+
+	for _, test := range identificationTests(width) {
+		with, without := []spn.Structure{}, []spn.Structure{}
+		for _, candidate := range candidates {
+			if test.has[candidate] {
+				with = append(with, candidate)
+			} else {
+				without = append(without, candidate)
+			}
+		}
+
+		if len(with) == 0 || len(without) == 0 {
+			continue
+		}
+
+		if test.test(rand, cipher, trials) {
+			candidates = with
+		} else {
+			candidates = without
+		}
+
+		failure += 1 / float64(uint(1)<<uint(trials))
+	}
+
+	return Identification{candidates[0], candidates, (1 - failure) / float64(len(candidates))}
+}
+
+// IdentifyStructure tests constr for the properties that tell SPN structures apart--cube sums, the span of outputs when
+// one position of the input is fixed, and relations in a last S-box layer--and returns its most likely reduced
+// structure. With 8-bit S-boxes, ASASA, ASASAS, and SASASA can't be told apart. Longer structures are identified as one
+// of those three. Random choices are read from rand.
+//
+// It returns ErrUnsupportedParams if the tests can't be run, and a *StageError if constr is an Oracle whose budget runs
+// out.
+func IdentifyStructure(rand io.Reader, constr Construction, params spn.Params) (Identification, error) {
+	return NewAttacker(DefaultOptions).IdentifyStructure(context.Background(), rand, constr, params)
+}
+
+// DecomposeUnknownSPN is DecomposeSPNWithParams for SPNs of unknown structure. It identifies the structure with
+// IdentifyStructure, and then decomposes it. It panics if the structure is ambiguous or the decomposition fails.
+func DecomposeUnknownSPN(constr Construction, params spn.Params) (spn.Construction, Identification) {
+	out, id, err := DecomposeUnknownSPNWithRand(rand.Reader, constr, params)
+	if err != nil {
+		panic(err)
+	}
+
+	return out, id
+}
+
+// DecomposeUnknownSPNWithRand is DecomposeUnknownSPN with every random choice read from rand, which returns an error
+// rather than panicking. It returns ErrAmbiguousStructure, along with the identification, if more than one structure is
+// consistent with the tests.
+func DecomposeUnknownSPNWithRand(rand io.Reader, constr Construction, params spn.Params) (spn.Construction, Identification, error) {
+	return DecomposeUnknownSPNWithContext(context.Background(), rand, constr, params, 1)
+}
+
+// DecomposeUnknownSPNWithContext is DecomposeSPNWithContext for SPNs of unknown structure. Only the decomposition is
+// spread across workers and stopped by ctx, not the identification.
+func DecomposeUnknownSPNWithContext(ctx context.Context, rand io.Reader, constr Construction, params spn.Params, workers int) (spn.Construction, Identification, error) {
+	return NewAttacker(Options{Workers: workers}).DecomposeUnknownSPN(ctx, rand, constr, params)
+}
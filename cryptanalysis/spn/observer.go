@@ -0,0 +1,156 @@
+package spn
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// EventKind is the type of an Event.
+type EventKind string
+
+const (
+	// StageStarted is sent when a stage starts recovering a layer.
+	StageStarted EventKind = "stage started"
+	// StageFinished is sent when a stage finishes, whether or not it succeeded.
+	StageFinished EventKind = "stage finished"
+	// RankProgress is sent when the rank of a stage's incremental matrices grows towards what the stage needs.
+	RankProgress EventKind = "rank progress"
+	// SubspaceAccepted is sent when low rank detection finds a new candidate subspace. Rank is the number of candidates
+	// it would keep so far.
+	SubspaceAccepted EventKind = "subspace accepted"
+	// SubspaceRejected is sent when low rank detection discards a subspace for repeating a candidate it already found.
+	SubspaceRejected EventKind = "subspace rejected"
+)
+
+// Event describes the progress of a stage. Layer is -1 and Queries and Elapsed are zero if the stage was run on its own,
+// rather than as part of a decomposition.
+type Event struct {
+	Kind  EventKind `json:"kind"`
+	Stage Stage     `json:"stage"`
+	Layer int       `json:"layer"`
+
+	// Generator names the plaintexts that a cube attack or low rank detection uses.
+	Generator string `json:"generator,omitempty"`
+
+	// Rank is the stage's progress towards Target: the smallest rank of its incremental matrices, or the number of
+	// subspaces it has kept.
+	Rank   int `json:"rank,omitempty"`
+	Target int `json:"target,omitempty"`
+
+	// Attempts is the number of attempts the stage has made.
+	Attempts int `json:"attempts,omitempty"`
+
+	// Queries and Elapsed are the number of queries the stage has made and the time since it started.
+	Queries int           `json:"queries"`
+	Elapsed time.Duration `json:"elapsed"`
+
+	// Err is the error the stage failed with, if it did.
+	Err string `json:"err,omitempty"`
+}
+
+// Observer is told about the progress of decompositions. Events from one decomposition are sent one at a time, from the
+// goroutine that called it.
+type Observer interface {
+	Observe(event Event)
+}
+
+// observerKey is the context key of an Observer.
+type observerKey struct{}
+
+// WithObserver returns a copy of ctx which reports the progress of the stages and decompositions it's passed to to
+// observer.
+func WithObserver(ctx context.Context, observer Observer) context.Context {
+	return context.WithValue(ctx, observerKey{}, observer)
+}
+
+// notify sends an event to ctx's observer, if it has one.
+func notify(ctx context.Context, event Event) {
+	if observer, ok := ctx.Value(observerKey{}).(Observer); ok {
+		observer.Observe(event)
+	}
+}
+
+// tracker is the Observer of one decomposition. It fills in the layer, generator, queries, and elapsed time of each
+// event from the current stage before passing it on.
+type tracker struct {
+	observer Observer
+	oracle   *Oracle
+
+	layer     int
+	generator string
+	start     time.Time
+}
+
+// track returns a copy of ctx whose observer, if it has one, is tracked through oracle.
+func track(ctx context.Context, oracle *Oracle) context.Context {
+	observer, ok := ctx.Value(observerKey{}).(Observer)
+	if !ok {
+		return ctx
+	}
+
+	return WithObserver(ctx, &tracker{observer: observer, oracle: oracle, layer: -1})
+}
+
+func (t *tracker) Observe(event Event) {
+	event.Layer, event.Generator = t.layer, t.generator
+	event.Queries, event.Elapsed = t.oracle.current().Queries, time.Since(t.start)
+
+	t.observer.Observe(event)
+}
+
+// beginStage attributes subsequent queries to the given stage and layer, and tells ctx's observer that the stage has
+// started. generator names the plaintexts the stage uses, if any.
+func beginStage(ctx context.Context, oracle *Oracle, stage Stage, layer int, generator string) {
+	oracle.begin(stage, layer)
+
+	if t, ok := ctx.Value(observerKey{}).(*tracker); ok {
+		t.layer, t.generator, t.start = layer, generator, time.Now()
+	}
+
+	notify(ctx, Event{Kind: StageStarted, Stage: stage, Layer: layer, Generator: generator})
+}
+
+// endStage tells ctx's observer that the current stage has finished with the given error.
+func endStage(ctx context.Context, oracle *Oracle, err error) {
+	current := oracle.current()
+
+	event := Event{Kind: StageFinished, Stage: current.Stage, Layer: current.Layer}
+	if err != nil {
+		event.Err = err.Error()
+	}
+
+	notify(ctx, event)
+}
+
+// JSONReporter is an Observer which writes each event as one line of JSON. It can be shared by decompositions running
+// at the same time.
+type JSONReporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	err error
+}
+
+// NewJSONReporter returns a JSONReporter which writes to w.
+func NewJSONReporter(w io.Writer) *JSONReporter {
+	return &JSONReporter{enc: json.NewEncoder(w)}
+}
+
+func (r *JSONReporter) Observe(event Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err == nil {
+		r.err = r.enc.Encode(event)
+	}
+}
+
+// Err returns the first error writing an event failed with. Nothing more is written after one fails.
+func (r *JSONReporter) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.err
+}
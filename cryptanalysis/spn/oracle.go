@@ -0,0 +1,106 @@
+package spn
+
+import "sync"
+
+// StageQueries is the number of queries one stage of a decomposition made while recovering one layer.
+type StageQueries struct {
+	Stage   Stage
+	Layer   int
+	Queries int
+}
+
+// Oracle wraps a Construction and counts the queries made to it. A decomposition run against an Oracle attributes each
+// query to the stage and layer it was made for. If Budget is positive, the decomposition fails with ErrBudgetExceeded
+// instead of making more than Budget queries. An Oracle can be queried from several goroutines at once if its
+// Construction can.
+type Oracle struct {
+	Construction
+	Budget int
+
+	mu      sync.Mutex
+	queries int
+	report  []StageQueries
+}
+
+// NewOracle returns an Oracle which allows budget queries to constr, or any number if budget is zero.
+func NewOracle(constr Construction, budget int) *Oracle {
+	return &Oracle{Construction: constr, Budget: budget}
+}
+
+// Encrypt queries the underlying construction. It panics with ErrBudgetExceeded if the budget is used up; the
+// decomposition functions and the exported stages recover this and return it as an error.
+func (o *Oracle) Encrypt(dst, src []byte) {
+	o.query()
+	o.Construction.Encrypt(dst, src)
+}
+
+// Decrypt queries the underlying construction in the decryption direction, against the same budget as Encrypt. It
+// panics if the construction isn't also a Decrypter.
+func (o *Oracle) Decrypt(dst, src []byte) {
+	o.query()
+	o.Construction.(Decrypter).Decrypt(dst, src)
+}
+
+// query counts one query, or panics with ErrBudgetExceeded if the budget is used up.
+func (o *Oracle) query() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.Budget > 0 && o.queries >= o.Budget {
+		panic(ErrBudgetExceeded)
+	}
+
+	o.queries++
+	if len(o.report) > 0 {
+		o.report[len(o.report)-1].Queries++
+	}
+}
+
+// Queries returns the total number of queries made.
+func (o *Oracle) Queries() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.queries
+}
+
+// Report returns the number of queries made by each stage, in the order the stages ran. Queries made outside of a
+// decomposition aren't attributed to any stage.
+func (o *Oracle) Report() []StageQueries {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return append([]StageQueries{}, o.report...)
+}
+
+// begin attributes subsequent queries to the given stage and layer.
+func (o *Oracle) begin(stage Stage, layer int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.report = append(o.report, StageQueries{stage, layer, 0})
+}
+
+// current returns the stage and layer that queries are currently attributed to.
+func (o *Oracle) current() StageQueries {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if len(o.report) == 0 {
+		return StageQueries{Layer: -1}
+	}
+
+	return o.report[len(o.report)-1]
+}
+
+// recoverBudget is deferred by the exported stages, so that a stage run on its own against an Oracle returns
+// ErrBudgetExceeded when the budget runs out, rather than panicking. Other panics are raised again.
+func recoverBudget(err *error) {
+	if r := recover(); r != nil {
+		if r != ErrBudgetExceeded {
+			panic(r)
+		}
+
+		*err = ErrBudgetExceeded
+	}
+}
@@ -0,0 +1,83 @@
+package spn
+
+import (
+	"io"
+	"sync"
+
+	"github.com/OpenWhiteBox/Generic/internal/random"
+)
+
+// parallel calls work(i) for every i from 0 to n-1, on up to workers goroutines at once, and returns once every call has
+// returned. If a call panics, the panic is raised again in the calling goroutine, so that an Oracle's budget running out
+// still reaches the decomposition.
+func parallel(workers, n int, work func(i int)) {
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			work(i)
+		}
+
+		return
+	}
+
+	jobs := make(chan int, n)
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		failure interface{}
+	)
+
+	for w := 0; w < workers && w < n; w++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					mu.Lock()
+					if failure == nil {
+						failure = r
+					}
+					mu.Unlock()
+				}
+			}()
+
+			for i := range jobs {
+				work(i)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if failure != nil {
+		panic(failure)
+	}
+}
+
+// batchSize returns how many of the remaining attempts to hand to workers at once.
+func batchSize(workers, remaining int) int {
+	if workers < 1 {
+		workers = 1
+	}
+
+	if remaining < workers {
+		return remaining
+	}
+
+	return workers
+}
+
+// substream returns a random source seeded from rand: the AES-CTR keystream under a random key. Work handed to another
+// goroutine reads from its own substream, so that its random choices don't depend on the order the goroutines run in.
+func substream(rand io.Reader) io.Reader {
+	key := make([]byte, 16)
+	random.ReadFull(rand, key)
+
+	stream, _ := random.KeyStream(key)
+	return stream
+}
@@ -0,0 +1,489 @@
+package spn
+
+import (
+	"context"
+	"io"
+
+	"github.com/OpenWhiteBox/primitives/encoding"
+	"github.com/OpenWhiteBox/primitives/matrix"
+
+	"github.com/OpenWhiteBox/Generic/internal/random"
+)
+
+// cubeDimension returns the dimension of the cubes that quadraticSubspaces sums over. In an ASASA cipher with width-bit
+// S-boxes, the product of two output bits of the same S-box in the last S-box layer has degree at most (width-1)^2 in
+// the plaintext, so it sums to zero over any affine subspace of one more dimension. That's 50 for 8-bit S-boxes.
+func cubeDimension(width int) int {
+	return (width-1)*(width-1) + 1
+}
+
+// maxCubeDimension is the largest dimension of cube an attack will sum over. Anything larger takes far too many queries.
+const maxCubeDimension = 20
+
+// pairs is the number of unordered pairs of distinct output bits.
+const pairs = 128 * 127 / 2
+
+// getBit returns the ith bit of a row.
+func getBit(row matrix.Row, i int) byte {
+	return (row[i/8] >> uint(i%8)) & 1
+}
+
+// toggleBit flips the ith bit of a row.
+func toggleBit(row matrix.Row, i int) {
+	row[i/8] ^= 1 << uint(i%8)
+}
+
+// pairIndex returns the position of the pair of output bits (a, b), with a < b, in a quadratic form.
+func pairIndex(a, b int) int {
+	return b*(b-1)/2 + a
+}
+
+// cube is an affine subspace of plaintexts: a starting point and the directions that span it.
+type cube struct {
+	x    [16]byte
+	dirs []matrix.Row
+}
+
+// randomCube returns a random cube of dimension dim.
+func randomCube(rand io.Reader, dim int) cube {
+	basis := matrix.NewIncrementalMatrix(128)
+	for basis.Len() < dim {
+		v := matrix.NewRow(128)
+		random.ReadFull(rand, v)
+		basis.Add(v)
+	}
+
+	c := cube{dirs: basis.Matrix()[0:dim]}
+	random.ReadFull(rand, c.x[:])
+
+	return c
+}
+
+// walk calls visit on every element of the cube.
+func (c cube) walk(visit func(x [16]byte)) {
+	x, dirs, dim := c.x, c.dirs, len(c.dirs)
+
+	// Walk the cube in Gray code order, so that each step only adds one direction.
+	for i := uint64(0); i < 1<<uint(dim); i++ {
+		if i > 0 {
+			dir := 0
+			for (i>>uint(dir))&1 == 0 {
+				dir++
+			}
+			encoding.XOR(x[:], x[:], dirs[dir])
+		}
+
+		visit(x)
+	}
+}
+
+// cubeSum sums the cipher's outputs over a cube.
+func cubeSum(cipher encoding.Block, c cube) matrix.Row {
+	out := matrix.NewRow(128)
+
+	c.walk(func(x [16]byte) {
+		y := cipher.Encode(x)
+		encoding.XOR(out, out, y[:])
+	})
+
+	return out
+}
+
+// quadraticForm sums the products of every pair of output bits over a cube. The coefficient of (a, b) is the sum of
+// ct_a * ct_b over the cube.
+func quadraticForm(cipher encoding.Block, c cube) matrix.Row {
+	acc := make([]matrix.Row, 128)
+	for a := range acc {
+		acc[a] = matrix.NewRow(128)
+	}
+
+	c.walk(func(x [16]byte) {
+		y := cipher.Encode(x)
+		for a := 0; a < 128; a++ {
+			if getBit(matrix.Row(y[:]), a) == 1 {
+				encoding.XOR(acc[a], acc[a], y[:])
+			}
+		}
+	})
+
+	out := matrix.NewRow(pairs)
+	for b := 1; b < 128; b++ {
+		for a := 0; a < b; a++ {
+			if getBit(acc[a], b) == 1 {
+				toggleBit(out, pairIndex(a, b))
+			}
+		}
+	}
+
+	return out
+}
+
+// wedge returns the pair coefficients of the product of the output masks u and v.
+func wedge(u, v matrix.Row) matrix.Row {
+	out := matrix.NewRow(pairs)
+
+	for b := 1; b < 128; b++ {
+		for a := 0; a < b; a++ {
+			if getBit(u, a)&getBit(v, b) != getBit(u, b)&getBit(v, a) {
+				toggleBit(out, pairIndex(a, b))
+			}
+		}
+	}
+
+	return out
+}
+
+// dropOutput returns a copy of a vector of pair coefficients without the pairs that involve output bit c.
+func dropOutput(v matrix.Row, c int) matrix.Row {
+	out := matrix.NewRow(pairs)
+	copy(out, v)
+
+	for other := 0; other < 128; other++ {
+		if other < c && getBit(out, pairIndex(other, c)) == 1 {
+			toggleBit(out, pairIndex(other, c))
+		} else if other > c && getBit(out, pairIndex(c, other)) == 1 {
+			toggleBit(out, pairIndex(c, other))
+		}
+	}
+
+	return out
+}
+
+// isZero returns true if every bit of a row is zero.
+func isZero(row matrix.Row) bool {
+	for _, b := range row {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// alternatingForm expands a vector of pair coefficients into the symmetric 128-by-128 matrix with zero diagonal that it
+// describes.
+func alternatingForm(v matrix.Row) matrix.Matrix {
+	m := make(matrix.Matrix, 128)
+	for a := range m {
+		m[a] = matrix.NewRow(128)
+	}
+
+	for b := 1; b < 128; b++ {
+		for a := 0; a < b; a++ {
+			if getBit(v, pairIndex(a, b)) == 1 {
+				toggleBit(m[a], b)
+				toggleBit(m[b], a)
+			}
+		}
+	}
+
+	return m
+}
+
+// spanOf returns the incremental matrix spanned by a set of rows.
+func spanOf(rows []matrix.Row) matrix.IncrementalMatrix {
+	out := matrix.NewIncrementalMatrix(128)
+	for _, row := range rows {
+		out.Add(row)
+	}
+
+	return out
+}
+
+// basisOf returns the rows of an incremental matrix which form its basis.
+func basisOf(im matrix.IncrementalMatrix) []matrix.Row {
+	return im.Matrix()[0:im.Len()]
+}
+
+// annihilator returns the incremental matrix of all vectors orthogonal to the given subspace.
+func annihilator(im matrix.IncrementalMatrix) matrix.IncrementalMatrix {
+	if im.Len() == 0 {
+		return spanOf(matrix.GenerateIdentity(128))
+	}
+
+	return spanOf(matrix.Matrix(basisOf(im)).NullSpace())
+}
+
+// masksOf returns the span of the output masks which the forms send the given subspace to. If the subspace is a sum of
+// column spaces of the last affine layer, then the result is the sum of the corresponding spaces of output masks.
+func masksOf(forms []matrix.Matrix, im matrix.IncrementalMatrix) matrix.IncrementalMatrix {
+	out := matrix.NewIncrementalMatrix(128)
+
+	for _, form := range forms {
+		for _, v := range basisOf(im) {
+			out.Add(form.Mul(v))
+		}
+	}
+
+	return out
+}
+
+// saturated is the number of cubes in a row that must fail to raise a rank before we decide it has stopped growing.
+const saturated = 64
+
+// affineMasks finds the output masks whose components have degree less than width in the plaintext, by summing the
+// output over cubes of dimension width until the span of the sums stops growing. In an ASASA cipher, these are exactly
+// the affine components of the S-boxes in the last S-box layer, which have the degree of the first S-box layer. It
+// returns the masks and the number of cubes it summed over.
+func affineMasks(ctx context.Context, rand io.Reader, cipher encoding.Block, width, workers int) (matrix.IncrementalMatrix, int, error) {
+	sums := matrix.NewIncrementalMatrix(128)
+
+	attempt, stale := 0, 0
+	for sums.Len() < 128 && stale < saturated {
+		if err := ctx.Err(); err != nil {
+			return sums, attempt, err
+		}
+
+		batch := make([]matrix.Row, batchSize(workers, saturated-stale))
+		chosen := make([]cube, len(batch))
+		for i := range chosen {
+			chosen[i] = randomCube(rand, width)
+		}
+
+		parallel(workers, len(batch), func(i int) {
+			batch[i] = cubeSum(cipher, chosen[i])
+		})
+
+		for _, sum := range batch {
+			before := sums.Len()
+			sums.Add(sum)
+			if sums.Len() > before {
+				stale = 0
+			} else {
+				stale++
+			}
+			attempt++
+		}
+	}
+
+	return annihilator(sums), attempt, nil
+}
+
+// liftMasks recovers the output masks of one S-box after the affine component of another S-box has been moved to output
+// bit phantom and dropped from the quadratic forms. masks is the span of the S-box's masks and the affine component, so
+// each of the S-box's masks is one of its lifts from masks modulo the affine component, plus an unknown multiple of the
+// affine component. The product of two masks of the same S-box is a vanishing form, which relations sends to zero, and
+// only one choice of multiples should make every product vanish. It returns false if none or several do.
+func liftMasks(relations matrix.Matrix, masks matrix.IncrementalMatrix, phantom int) ([]matrix.Row, bool) {
+	affine := matrix.NewRow(128)
+	toggleBit(affine, phantom)
+
+	lifts, quotient := []matrix.Row{}, spanOf([]matrix.Row{affine})
+	for _, row := range basisOf(masks) {
+		before := quotient.Len()
+		quotient.Add(row)
+		if quotient.Len() > before {
+			lifts = append(lifts, row)
+		}
+	}
+
+	products, shifts := make([][]matrix.Row, len(lifts)), make([]matrix.Row, len(lifts))
+	for i := range lifts {
+		products[i] = make([]matrix.Row, len(lifts))
+		for j := i + 1; j < len(lifts); j++ {
+			products[i][j] = relations.Mul(wedge(lifts[i], lifts[j]))
+		}
+		shifts[i] = relations.Mul(wedge(lifts[i], affine))
+	}
+
+	var out []matrix.Row
+	for choice := 0; choice < 1<<uint(len(lifts)); choice++ {
+		vanishes := true
+		for i := range lifts {
+			for j := i + 1; j < len(lifts) && vanishes; j++ {
+				v := products[i][j]
+				if (choice>>uint(j))&1 == 1 {
+					v = v.Add(shifts[i])
+				}
+				if (choice>>uint(i))&1 == 1 {
+					v = v.Add(shifts[j])
+				}
+				vanishes = isZero(v)
+			}
+		}
+
+		if !vanishes {
+			continue
+		} else if out != nil {
+			return nil, false
+		}
+
+		out = make([]matrix.Row, len(lifts))
+		for i, row := range lifts {
+			out[i] = row
+			if (choice>>uint(i))&1 == 1 {
+				out[i] = row.Add(affine)
+			}
+		}
+	}
+
+	return out, out != nil
+}
+
+// quadraticSubspaces generates subspaces by finding the quadratic forms that vanish on every cube and splitting the
+// output space along them. Each subspace is the span of all but one S-box's column space in the last affine layer.
+//
+// The quadratic forms which vanish are exactly the alternating forms supported on the output masks of a single S-box.
+// The kernel of a random such form lies in the column spaces of the S-boxes where it is singular, which lets us split
+// the output space into a sum of S-boxes where the form is singular and a sum of S-boxes where it isn't. Repeating with
+// different forms separates every S-box from every other.
+//
+// The cubes have 2^((width-1)^2+1) elements each, so this is practical for 4-bit S-boxes, but not for 8-bit S-boxes.
+//
+// An affine component of an S-box in the last S-box layer has low degree, so its product with any quadratic component
+// of another S-box vanishes too, and there's no telling in advance how many more forms vanish. So we look for affine
+// components first, with cheap cubes of dimension width. If there's one, we move it to an output bit of its own, collect
+// forms until no more cubes add relations, and drop every pair with that bit before splitting. That leaves its S-box one
+// output short, and which multiple of the affine component belongs to each other S-box is recovered at the end by
+// checking which one makes the products of its masks vanish. With 4-bit S-boxes, about two thirds of random last S-box
+// layers have at most one affine component. More than one fails with ErrAffineComponents, because S-boxes left with an
+// odd number of outputs are always singular and can't be split from each other.
+//
+// Cubes are chosen in batches of workers, which sum over one cube each.
+func (a *Attacker) quadraticSubspaces(ctx context.Context, rand io.Reader, cipher encoding.Block, width, workers int) (subspaces []matrix.IncrementalMatrix, err error) {
+	sboxes, dim := 128/width, cubeDimension(width)
+
+	affine, attempt, err := affineMasks(ctx, rand, cipher, width, workers)
+	if err != nil {
+		return nil, &StageError{QuadraticSubspaces, -1, attempt, err}
+	} else if affine.Len() > 1 {
+		return nil, &StageError{QuadraticSubspaces, -1, attempt, ErrAffineComponents}
+	}
+
+	// Change coordinates so that the affine component, if there is one, is output bit phantom. The change of
+	// coordinates is its own inverse.
+	basis, phantom := matrix.GenerateIdentity(128), -1
+	if affine.Len() == 1 {
+		component := basisOf(affine)[0]
+		for phantom = 0; getBit(component, phantom) == 0; phantom++ {
+		}
+
+		basis[phantom] = component
+		cipher = encoding.ComposedBlocks{cipher, encoding.NewBlockLinear(basis)}
+	}
+
+	// Each S-box contributes width*(width-1)/2 alternating forms over its output masks.
+	expected := pairs - sboxes*width*(width-1)/2
+
+	relations := matrix.NewIncrementalMatrix(pairs)
+
+	cubes, stale := a.opts.QuadraticCubes*pairs, 0
+	for attempt = 0; attempt < cubes && relations.Len() < expected && stale < saturated; {
+		if err := ctx.Err(); err != nil {
+			return nil, &StageError{QuadraticSubspaces, -1, attempt, err}
+		}
+
+		batch := make([]matrix.Row, batchSize(workers, cubes-attempt))
+		chosen := make([]cube, len(batch))
+		for i := range chosen {
+			chosen[i] = randomCube(rand, dim)
+		}
+
+		parallel(workers, len(batch), func(i int) {
+			batch[i] = quadraticForm(cipher, chosen[i])
+		})
+
+		for i := 0; i < len(batch) && relations.Len() < expected && stale < saturated; i++ {
+			before := relations.Len()
+			relations.Add(batch[i])
+			if relations.Len() > before {
+				stale = 0
+			} else {
+				stale++
+			}
+			attempt++
+		}
+		notify(ctx, Event{Kind: RankProgress, Stage: QuadraticSubspaces, Layer: -1, Rank: relations.Len(), Target: expected, Attempts: attempt})
+	}
+
+	if relations.Len() != expected && (phantom < 0 || stale < saturated) {
+		return nil, &StageError{QuadraticSubspaces, -1, attempt, ErrNotEnoughForms}
+	}
+
+	kernel := matrix.Matrix(basisOf(relations)).NullSpace()
+	forms := make([]matrix.Matrix, len(kernel))
+	for i, v := range kernel {
+		if phantom >= 0 {
+			kernel[i] = dropOutput(v, phantom)
+		}
+		forms[i] = alternatingForm(kernel[i])
+	}
+
+	outputs := matrix.NewIncrementalMatrix(128)
+	for i, row := range matrix.GenerateIdentity(128) {
+		if i != phantom {
+			outputs.Add(row)
+		}
+	}
+	parts := []matrix.IncrementalMatrix{outputs}
+
+	for attempt = 0; attempt < a.opts.QuadraticSplits && len(parts) < sboxes; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, &StageError{QuadraticSubspaces, -1, attempt, err}
+		}
+
+		coeffs := make([]byte, (len(kernel)+7)/8)
+		random.ReadFull(rand, coeffs)
+
+		v := matrix.NewRow(pairs)
+		for i, row := range kernel {
+			if getBit(matrix.Row(coeffs), i) == 1 {
+				v = v.Add(row)
+			}
+		}
+
+		// Close the kernel up into whole S-boxes on both sides of the split. The forms send a kernel vector of an
+		// S-box with an odd number of outputs to only some of its masks, which leaves the vector on the other side too,
+		// but the random form sends it to zero, so it can't pull its S-box out of this side.
+		form := alternatingForm(v)
+		other := annihilator(masksOf(forms, spanOf(form.NullSpace())))
+		this := annihilator(masksOf([]matrix.Matrix{form}, other))
+		other = annihilator(masksOf(forms, this))
+
+		next := []matrix.IncrementalMatrix{}
+		for _, part := range parts {
+			for _, side := range []matrix.IncrementalMatrix{this, other} {
+				if piece := findIntersection(part, side); piece.Len() > 0 {
+					next = append(next, piece)
+				}
+			}
+		}
+		parts = next
+	}
+
+	if len(parts) != sboxes {
+		return nil, &StageError{QuadraticSubspaces, -1, attempt, ErrSplit}
+	}
+
+	for excluded := 0; excluded < sboxes; excluded++ {
+		others := matrix.NewIncrementalMatrix(128)
+
+		for i, part := range parts {
+			if i != excluded {
+				for _, row := range basisOf(part) {
+					others.Add(row)
+				}
+			}
+		}
+
+		// The masks of the excluded S-box are whatever vanishes on every other S-box, along with the affine component
+		// if it belongs to a different S-box.
+		masks := basisOf(annihilator(others))
+		if len(masks) > width {
+			var ok bool
+			if masks, ok = liftMasks(matrix.Matrix(basisOf(relations)), spanOf(masks), phantom); !ok {
+				return nil, &StageError{QuadraticSubspaces, -1, attempt, ErrSplit}
+			}
+		}
+
+		subspace := matrix.NewIncrementalMatrix(128)
+		for _, mask := range masks {
+			subspace.Add(basis.Transpose().Mul(mask))
+		}
+
+		subspaces = append(subspaces, annihilator(subspace))
+	}
+
+	sortSubspaces(subspaces)
+	return
+}
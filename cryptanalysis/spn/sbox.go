@@ -1,11 +1,17 @@
 package spn
 
 import (
-	"crypto/rand"
+	"context"
+	"io"
+	"math"
 
 	"github.com/OpenWhiteBox/primitives/encoding"
 	"github.com/OpenWhiteBox/primitives/gfmatrix"
+	"github.com/OpenWhiteBox/primitives/matrix"
 	"github.com/OpenWhiteBox/primitives/number"
+
+	"github.com/OpenWhiteBox/Generic/constructions/spn"
+	"github.com/OpenWhiteBox/Generic/internal/gf2"
 )
 
 // incrementalMatrices implements succint operations over a slice of incremental matrices.
@@ -21,12 +27,12 @@ func newIncrementalMatrices(x, n int) (ims incrementalMatrices) {
 	return
 }
 
-// SufficientlyDefined returns true if every incremental matrix is sufficiently defined. The must all have a
-// 9-dimensional nullspace or smallter. This way, it is small enough to search, but not so small that we have nowhere to
-// look for solutions.
-func (ims incrementalMatrices) SufficientlyDefined() bool {
+// SufficientlyDefined returns true if every incremental matrix is sufficiently defined, for S-boxes width bits wide.
+// They must all have a nullity-dimensional nullspace or smaller--by default, 9-dimensional for 8-bit S-boxes. This way,
+// it is small enough to search, but not so small that we have nowhere to look for solutions.
+func (ims incrementalMatrices) SufficientlyDefined(width, nullity int) bool {
 	for _, im := range ims {
-		if im.Len() < 247 {
+		if im.Len() < 1<<uint(width)-nullity {
 			return false
 		}
 	}
@@ -44,82 +50,270 @@ func (ims incrementalMatrices) Matrices() (out []gfmatrix.Matrix) {
 	return out
 }
 
-// randomLinearCombination returns a random linear combination of a set of basis vectors.
-func randomLinearCombination(basis []gfmatrix.Row) gfmatrix.Row {
-	coeffs := make([]byte, len(basis))
-	rand.Read(coeffs)
+// sboxFunctions returns a basis for the functions from width-bit values to bits in the span of basis, with their constant
+// terms removed so that each is zero at zero. The relations have 0/1 entries, so the solutions have a basis with 0/1
+// entries and each basis vector is such a function.
+func sboxFunctions(basis []gfmatrix.Row, width int) []matrix.Row {
+	n := 1 << uint(width)
+	span := matrix.NewIncrementalMatrix(n)
 
-	v := gfmatrix.NewRow(basis[0].Size())
+	for _, b := range basis {
+		f := matrix.NewRow(n)
+		for x := 0; x < n; x++ {
+			if (b[x] != 0) != (b[0] != 0) {
+				toggleBit(f, x)
+			}
+		}
 
-	for i, c_i := range coeffs {
-		v = v.Add(basis[i].ScalarMul(number.ByteFieldElem(c_i)))
+		span.Add(f)
 	}
 
-	return v
+	return span.Matrix()[0:span.Len()]
 }
 
-// findPermutation takes a set of vectors and finds a linear combination of them that gives a permutation vector.
-func findPermutation(basis []gfmatrix.Row) gfmatrix.Row {
-	for true {
-		v := randomLinearCombination(basis)
+// countSubspaces returns the number of dim-dimensional subspaces of GF(2)^n.
+func countSubspaces(n, dim int) float64 {
+	count := 1.0
+	for i := 0; i < dim; i++ {
+		count *= (math.Exp2(float64(n-i)) - 1) / (math.Exp2(float64(i+1)) - 1)
+	}
+
+	return count
+}
+
+// forEachSubspace calls visit with the basis of every dim-dimensional subspace of GF(2)^n in reduced row echelon form,
+// with each vector packed into a uint64, until visit returns false. n must be at most 64.
+func forEachSubspace(n, dim int, visit func(rows []uint64) bool) {
+	pivots, rows := make([]int, dim), make([]uint64, dim)
+
+	var choose func(i, from int) bool
+	choose = func(i, from int) bool {
+		if i < dim {
+			for p := from; p <= n-dim+i; p++ {
+				pivots[i] = p
+				if !choose(i+1, p+1) {
+					return false
+				}
+			}
+
+			return true
+		}
 
-		if v[:256].IsPermutation() {
-			return v
+		// Every entry after a row's pivot is free, except for the other rows' pivots.
+		isPivot := make([]bool, n)
+		for _, p := range pivots {
+			isPivot[p] = true
+		}
+
+		type entry struct{ row, col int }
+		free := []entry{}
+		for row, p := range pivots {
+			for col := p + 1; col < n; col++ {
+				if !isPivot[col] {
+					free = append(free, entry{row, col})
+				}
+			}
 		}
+
+		for assignment := uint64(0); assignment < 1<<uint(len(free)); assignment++ {
+			for row, p := range pivots {
+				rows[row] = 1 << uint(p)
+			}
+			for j, e := range free {
+				rows[e.row] |= (assignment >> uint(j) & 1) << uint(e.col)
+			}
+
+			if !visit(rows) {
+				return false
+			}
+		}
+
+		return true
 	}
 
-	return nil
+	choose(0, 0)
 }
 
-// newSBox takes a permutation vector as input and returns its corresponding S-Box. It inverts the S-Box if backwards is
-// true (because the permutation vector we found was for the inverse S-box).
-func newSBox(v gfmatrix.Row, backwards bool) (out encoding.SBox) {
-	for i, v_i := range v[0:256] {
-		out.EncKey[i] = byte(v_i)
+// permutationVector returns the vector on width-bit values whose ith bit is given by bits[i], if it's a permutation. It
+// stops at the first value that repeats.
+func permutationVector(bits []matrix.Row, width int) (gfmatrix.Row, bool) {
+	n := 1 << uint(width)
+	v, seen := gfmatrix.NewRow(n), make([]bool, n)
+
+	for x := 0; x < n; x++ {
+		y := 0
+		for i, f := range bits {
+			y |= int(f.GetBit(x)) << uint(i)
+		}
+
+		if seen[y] {
+			return nil, false
+		}
+		seen[y], v[x] = true, number.ByteFieldElem(y)
 	}
 
-	for i, j := range out.EncKey {
-		out.DecKey[j] = byte(i)
+	return v, true
+}
+
+// findPermutations takes a basis for the solutions to the relations on a width-bit S-box and returns every permutation
+// vector in their span, up to an affine map on its values. Each one is normalized so that it maps zero to zero and the
+// functions giving its bits are in reduced row echelon form, lowest bit first.
+//
+// A permutation's bits span a width-dimensional subspace of the solutions without constant terms, so every such subspace
+// is searched in turn, and the result doesn't depend on the basis. With the default options, the solutions have exactly
+// one such subspace. It returns ErrTooManyCandidates if there are more than limit subspaces, and ErrNoPermutation if
+// none of them gives a permutation.
+func findPermutations(basis []gfmatrix.Row, width, limit int) ([]gfmatrix.Row, error) {
+	functions := sboxFunctions(basis, width)
+	if len(functions) < width {
+		return nil, ErrNoPermutation
+	} else if len(functions) > 64 || countSubspaces(len(functions), width) > float64(limit) {
+		return nil, ErrTooManyCandidates
 	}
 
+	candidates := []gfmatrix.Row{}
+
+	forEachSubspace(len(functions), width, func(rows []uint64) bool {
+		bits := make([]matrix.Row, width)
+		for i, row := range rows {
+			bits[i] = matrix.NewRow(1 << uint(width))
+
+			for j, f := range functions {
+				if row>>uint(j)&1 == 1 {
+					bits[i] = bits[i].Add(f)
+				}
+			}
+		}
+		bits = gf2.ReducedRows(bits)
+
+		if v, ok := permutationVector(bits, width); ok {
+			candidates = append(candidates, v)
+		}
+
+		return true
+	})
+
+	if len(candidates) == 0 {
+		return nil, ErrNoPermutation
+	}
+
+	return candidates, nil
+}
+
+// newSBox takes a permutation vector as input and returns its corresponding S-Box. It inverts the S-Box if backwards is
+// true (because the permutation vector we found was for the inverse S-box).
+func newSBox(v gfmatrix.Row, width int, backwards bool) spn.SBox {
+	key := make([]uint16, 1<<uint(width))
+	for i := range key {
+		key[i] = uint16(v[i])
+	}
+
+	out := spn.NewSBox(key)
 	if backwards { // Reverse EncKey and DecKey if we recover S^-1
 		out.EncKey, out.DecKey = out.DecKey, out.EncKey
 	}
 
-	return
+	return out
+}
+
+// encryptAll encrypts a set of plaintexts.
+func encryptAll(cipher encoding.Block, pts [][16]byte) [][16]byte {
+	cts := make([][16]byte, len(pts))
+
+	for i, pt := range pts {
+		cts[i] = cipher.Encode(pt)
+	}
+
+	return cts
 }
 
-// RecoverSBoxes implements a specific variant of the Cube attack to remove the trailing S-box layer of the given
-// cipher. It uses the plaintexts generated by generator.
-func RecoverSBoxes(cipher encoding.Block, generator func() [][16]byte) (last encoding.ConcatenatedBlock, rest encoding.Block) {
-	ims := newIncrementalMatrices(16, 256)
+// relation returns the relation that a set of ciphertexts gives on the width-bit S-box at position pos in the cipher's
+// last layer: which outputs of the S-box appear an odd number of times.
+func relation(cts [][16]byte, pos, width int) gfmatrix.Row {
+	row := gfmatrix.NewRow(1 << uint(width))
 
-	for attempt := 0; attempt < 2000 && !ims.SufficientlyDefined(); attempt++ {
-		pts := generator()
-		cts := make([][16]byte, len(pts))
+	for _, ct := range cts {
+		x := gf2.GetChunk(ct[:], pos*width, width)
+		row[x] = row[x].Add(0x01)
+	}
+
+	return row
+}
+
+// addRelations encrypts a set of plaintexts and adds the relation it gives on each S-box.
+func addRelations(ims incrementalMatrices, cipher encoding.Block, width int, pts [][16]byte) {
+	cts := encryptAll(cipher, pts)
+
+	for pos := range ims {
+		ims[pos].Add(relation(cts, pos, width))
+	}
+}
+
+// RecoverSBoxes is the attacker's RecoverSBoxes, with sets of plaintexts generated in batches of workers. It gives up
+// after as many attempts as DefaultOptions allows.
+func RecoverSBoxes(ctx context.Context, rand io.Reader, cipher encoding.Block, width, workers int, generator Generator) (last spn.SBoxLayer, rest encoding.Block, err error) {
+	return NewAttacker(Options{Workers: workers}).RecoverSBoxes(ctx, rand, cipher, width, generator)
+}
 
-		for i, pt := range pts {
-			cts[i] = cipher.Encode(pt)
+// RecoverSBoxes implements a specific variant of the Cube attack to remove the trailing layer of width-bit S-boxes of the
+// given cipher. It uses the plaintexts generated by generator, and reads random choices from rand. Sets of plaintexts are
+// generated in batches of the attacker's workers, which encrypt one set each and then add the relations for one S-box
+// each. It returns a *StageError if it doesn't find enough relations within CubeAttempts sets, if more than one S-box
+// is consistent with the relations on any position, or if ctx is done first. It returns ErrBudgetExceeded if cipher
+// queries an Oracle whose budget runs out.
+func (a *Attacker) RecoverSBoxes(ctx context.Context, rand io.Reader, cipher encoding.Block, width int, generator Generator) (last spn.SBoxLayer, rest encoding.Block, err error) {
+	defer recoverBudget(&err)
+
+	sboxes, workers, nullity := 128/width, a.opts.Workers, a.nullity(width)
+	ims := newIncrementalMatrices(sboxes, 1<<uint(width))
+
+	attempt := 0
+	for attempt < a.opts.CubeAttempts && !ims.SufficientlyDefined(width, nullity) {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, &StageError{CubeAttack, -1, attempt, err}
+		}
+
+		batch := make([][][16]byte, batchSize(workers, a.opts.CubeAttempts-attempt))
+		for i := range batch {
+			batch[i] = generator(rand)
 		}
 
-		for pos := 0; pos < 16; pos++ {
-			row := gfmatrix.NewRow(256)
+		parallel(workers, len(batch), func(i int) {
+			batch[i] = encryptAll(cipher, batch[i])
+		})
 
-			for _, ct := range cts {
-				row[ct[pos]] = row[ct[pos]].Add(0x01)
+		parallel(workers, sboxes, func(pos int) {
+			for _, cts := range batch {
+				ims[pos].Add(relation(cts, pos, width))
 			}
+		})
 
-			ims[pos].Add(row)
+		attempt += len(batch)
+
+		rank := 1 << uint(width)
+		for _, im := range ims {
+			if im.Len() < rank {
+				rank = im.Len()
+			}
 		}
+		notify(ctx, Event{Kind: RankProgress, Stage: CubeAttack, Layer: -1, Rank: rank, Target: 1<<uint(width) - nullity, Attempts: attempt})
 	}
 
-	if !ims.SufficientlyDefined() {
-		panic("Cube attack failed to find enough linear relations in the S-boxes.")
+	if !ims.SufficientlyDefined(width, nullity) {
+		return nil, nil, &StageError{CubeAttack, -1, attempt, ErrNotEnoughRelations}
 	}
 
+	last = make(spn.SBoxLayer, sboxes)
 	for pos, m := range ims.Matrices() {
-		last[pos] = newSBox(findPermutation(m.NullSpace()), true)
+		candidates, err := findPermutations(m.NullSpace(), width, a.opts.SBoxCandidates)
+		if err != nil {
+			return nil, nil, &StageError{CubeAttack, -1, attempt, err}
+		} else if len(candidates) > 1 {
+			return nil, nil, &StageError{CubeAttack, -1, attempt, ErrAmbiguousSBox}
+		}
+
+		last[pos] = newSBox(candidates[0], width, true)
 	}
 
-	return last, encoding.ComposedBlocks{cipher, encoding.InverseBlock{last}}
+	return last, encoding.ComposedBlocks{cipher, encoding.InverseBlock{spn.ToBlock(last)}}, nil
 }
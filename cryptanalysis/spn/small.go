@@ -0,0 +1,538 @@
+package spn
+
+import (
+	"crypto/rand"
+	"io"
+
+	"github.com/OpenWhiteBox/primitives/gfmatrix"
+	"github.com/OpenWhiteBox/primitives/matrix"
+	"github.com/OpenWhiteBox/primitives/number"
+
+	"github.com/OpenWhiteBox/Generic/constructions/spn"
+	"github.com/OpenWhiteBox/Generic/internal/random"
+)
+
+// SmallConstruction represents an implementation of a small SPN block cipher, with 8-bit blocks and 4-bit S-boxes. See
+// constructions/spn.SmallConstruction.
+type SmallConstruction interface {
+	Encrypt(byte) byte
+}
+
+// codebook is the full table of a permutation on bytes.
+type codebook [256]byte
+
+// identity returns the codebook of the identity permutation.
+func identity() (out codebook) {
+	for x := range out {
+		out[x] = byte(x)
+	}
+
+	return
+}
+
+// inverse returns the codebook of the inverse permutation.
+func (cb codebook) inverse() (out codebook) {
+	for x, y := range cb {
+		out[y] = byte(x)
+	}
+
+	return
+}
+
+// peel removes a layer from the output of the permutation.
+func (cb codebook) peel(layer spn.Layer) (out codebook) {
+	for x, y := range cb {
+		temp := []byte{y}
+		layer.Decode(temp, temp)
+		out[x] = temp[0]
+	}
+
+	return
+}
+
+// unpeel removes a layer from the input of the permutation.
+func (cb codebook) unpeel(layer spn.Layer) (out codebook) {
+	for x := range cb {
+		temp := []byte{byte(x)}
+		layer.Decode(temp, temp)
+		out[x] = cb[temp[0]]
+	}
+
+	return
+}
+
+// nibble returns the pos^th nibble of x.
+func nibble(x byte, pos int) int { return int(x>>uint(4*pos)) & 0x0f }
+
+// span8 is a subspace of GF(2)^8 in reduced echelon form. The i^th entry is the basis vector whose leading bit is bit i,
+// or zero if there isn't one. Equal subspaces have equal representations.
+type span8 [8]byte
+
+// reduce returns the canonical representative of x's coset of the subspace.
+func (s *span8) reduce(x byte) byte {
+	for i := 7; i >= 0; i-- {
+		if (x>>uint(i))&1 == 1 && s[i] != 0 {
+			x ^= s[i]
+		}
+	}
+
+	return x
+}
+
+// add adds x to the subspace.
+func (s *span8) add(x byte) {
+	x = s.reduce(x)
+
+	for i := 7; i >= 0; i-- {
+		if (x>>uint(i))&1 == 1 {
+			s[i] = x
+
+			for j := i + 1; j < 8; j++ {
+				if (s[j]>>uint(i))&1 == 1 {
+					s[j] ^= x
+				}
+			}
+
+			return
+		}
+	}
+}
+
+// basis returns a basis of the subspace.
+func (s *span8) basis() (out []byte) {
+	for _, b := range s {
+		if b != 0 {
+			out = append(out, b)
+		}
+	}
+
+	return
+}
+
+// dim returns the dimension of the subspace.
+func (s *span8) dim() int { return len(s.basis()) }
+
+// cosets returns the cosets of the subspace.
+func (s *span8) cosets() (out [][]byte) {
+	index := [256]int{}
+	for x := 0; x < 256; x++ {
+		rep := s.reduce(byte(x))
+		if index[rep] == 0 {
+			out = append(out, make([]byte, 0, 256>>uint(8-s.dim())))
+			index[rep] = len(out)
+		}
+
+		out[index[rep]-1] = append(out[index[rep]-1], byte(x))
+	}
+
+	return
+}
+
+// affineFromColumns returns the linear layer which sends the i^th unit vector to columns[i].
+func affineFromColumns(columns []byte) spn.AffineLayer {
+	m := matrix.Matrix{}
+	for row := uint(0); row < 8; row++ {
+		r := byte(0)
+		for i, c := range columns {
+			r |= ((c >> row) & 1) << uint(i)
+		}
+
+		m = append(m, matrix.Row{r})
+	}
+
+	return spn.NewAffineLayer(m, []byte{0})
+}
+
+// splits takes candidate subspaces, each of which might be the column space of one S-box, and returns the linear layers
+// given by every complementary pair.
+func splits(cands []span8) (out []spn.AffineLayer) {
+	distinct, seen := []span8{}, map[span8]bool{}
+	for _, cand := range cands {
+		if cand.dim() == 4 && !seen[cand] {
+			distinct, seen[cand] = append(distinct, cand), true
+		}
+	}
+
+	for i := range distinct {
+		for j := i + 1; j < len(distinct); j++ {
+			s := distinct[i]
+			for _, b := range distinct[j].basis() {
+				s.add(b)
+			}
+
+			if s.dim() == 8 {
+				out = append(out, affineFromColumns(append(distinct[i].basis(), distinct[j].basis()...)))
+			}
+		}
+	}
+
+	return
+}
+
+// trivialColumns finds the column space of each S-box under the last affine layer of an AS cipher, by fixing the other
+// S-box's input to zero. The column spaces are returned in order, so the layer under the affine layer isn't permuted.
+func trivialColumns(cb codebook) (out []span8) {
+	for pos := 0; pos < 2; pos++ {
+		s := span8{}
+		for x := 0; x < 256; x++ {
+			if nibble(byte(x), 1-pos) == 0 {
+				s.add(cb[x] ^ cb[0])
+			}
+		}
+
+		out = append(out, s)
+	}
+
+	return
+}
+
+// differenceColumns finds the column spaces of the S-boxes under the last affine layer of an ASA cipher, by looking for
+// input differences which don't activate one S-box.
+func differenceColumns(cb codebook) (out []span8) {
+	for delta := 1; delta < 256; delta++ {
+		s := span8{}
+		for x := 0; x < 256; x++ {
+			s.add(cb[x] ^ cb[x^delta])
+		}
+
+		out = append(out, s)
+	}
+
+	return
+}
+
+// nibbleRelations accumulates linear relations on the inverse of each S-box in the last S-box layer.
+type nibbleRelations [2]matrix.IncrementalMatrix
+
+func newNibbleRelations() nibbleRelations {
+	return nibbleRelations{matrix.NewIncrementalMatrix(16), matrix.NewIncrementalMatrix(16)}
+}
+
+// add adds the relation that the inverse S-boxes sum to zero over the ciphertexts of a set of plaintexts.
+func (nr *nibbleRelations) add(cb codebook, pts []byte) {
+	for pos := range nr {
+		row := matrix.NewRow(16)
+		for _, pt := range pts {
+			toggleBit(row, nibble(cb[pt], pos))
+		}
+
+		nr[pos].Add(row)
+	}
+}
+
+// sufficientlyDefined returns true if every inverse S-box is determined up to an affine transformation. The nullspace
+// always contains the constant function and the four output bits of the inverse S-box.
+func (nr *nibbleRelations) sufficientlyDefined() bool {
+	return nr[0].Len() >= 11 && nr[1].Len() >= 11
+}
+
+// sboxes returns every S-box in the pos^th position whose inverse satisfies the relations, up to an affine
+// transformation. There's only one unless the relations are ambiguous.
+func (nr *nibbleRelations) sboxes(pos int) (out []spn.SBox) {
+	basis := []gfmatrix.Row{}
+	for _, v := range matrix.Matrix(basisOf(nr[pos])).NullSpace() {
+		row := gfmatrix.NewRow(16)
+		for y := range row {
+			row[y] = number.ByteFieldElem(getBit(v, y))
+		}
+
+		basis = append(basis, row)
+	}
+
+	candidates, err := findPermutations(basis, 4, DefaultOptions.SBoxCandidates)
+	if err != nil {
+		return nil
+	}
+
+	for _, v := range candidates {
+		out = append(out, newSBox(v, 4, true))
+	}
+
+	return
+}
+
+// sboxCandidates finds the last S-box layer of a small cipher with the cube attack, using the sets of plaintexts that
+// generator returns. It returns every S-box layer consistent with the relations it finds.
+func sboxCandidates(rand io.Reader, cb codebook, generator func(io.Reader) [][]byte) (out []spn.SBoxLayer) {
+	nr := newNibbleRelations()
+
+	for attempt := 0; attempt < 64 && !nr.sufficientlyDefined(); attempt++ {
+		for _, pts := range generator(rand) {
+			nr.add(cb, pts)
+		}
+	}
+
+	for _, sbox0 := range nr.sboxes(0) {
+		for _, sbox1 := range nr.sboxes(1) {
+			out = append(out, spn.SBoxLayer{sbox0, sbox1})
+		}
+	}
+
+	return
+}
+
+// balancedSets returns random sets of four plaintexts which sum to zero.
+func balancedSets(rand io.Reader) (out [][]byte) {
+	for i := 0; i < 16; i++ {
+		pts := make([]byte, 3)
+		random.ReadFull(rand, pts)
+
+		out = append(out, append(pts, pts[0]^pts[1]^pts[2]))
+	}
+
+	return
+}
+
+// dualSets returns random sets of four plaintexts where each nibble takes two values twice each.
+func dualSets(rand io.Reader) (out [][]byte) {
+	for i := 0; i < 16; i++ {
+		ab := make([]byte, 2)
+		random.ReadFull(rand, ab)
+
+		a, b := ab[0], ab[1]
+		out = append(out, []byte{a, b, a&0x0f | b&0xf0, b&0x0f | a&0xf0})
+	}
+
+	return
+}
+
+// subspaceSets returns every coset of random 4-dimensional subspaces.
+func subspaceSets(rand io.Reader) (out [][]byte) {
+	for i := 0; i < 4; i++ {
+		s := span8{}
+		for s.dim() < 4 {
+			x := make([]byte, 1)
+			random.ReadFull(rand, x)
+			s.add(x[0])
+		}
+
+		out = append(out, s.cosets()...)
+	}
+
+	return
+}
+
+// permutationSets returns every set of plaintexts where one nibble takes every value and the other is constant.
+func permutationSets(io.Reader) (out [][]byte) {
+	for pos := 0; pos < 2; pos++ {
+		for c := 0; c < 16; c++ {
+			pts := []byte{}
+			for v := 0; v < 16; v++ {
+				pts = append(pts, byte(v<<uint(4*pos)|c<<uint(4*(1-pos))))
+			}
+
+			out = append(out, pts)
+		}
+	}
+
+	return
+}
+
+// inputCandidates finds the first affine layer of a small cipher. It tries every 4-dimensional subspace of inputs and
+// keeps those where balanced holds on the cosets, which happens when the first affine layer maps the subspace onto the
+// input of one S-box.
+func inputCandidates(cb codebook, balanced func(codebook, [][]byte) bool) (out []spn.AffineLayer) {
+	cands := []span8{}
+
+	forEachSubspace(8, 4, func(basis []uint64) bool {
+		s := span8{}
+		for _, b := range basis {
+			s.add(byte(b))
+		}
+
+		if balanced(cb, s.cosets()) {
+			cands = append(cands, s)
+		}
+
+		return true
+	})
+
+	// Each split sends the input of each S-box to one of the subspaces we found, so the first layer is its inverse.
+	for _, split := range splits(cands) {
+		out = append(out, split.Inverse())
+	}
+
+	return
+}
+
+// sumsToZero returns true if the ciphertexts of each set of plaintexts sum to zero.
+func sumsToZero(cb codebook, sets [][]byte) bool {
+	for _, pts := range sets {
+		sum := byte(0)
+		for _, pt := range pts {
+			sum ^= cb[pt]
+		}
+
+		if sum != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sboxesSumToZero returns true if there could be inverse S-boxes which make the ciphertexts of each set of plaintexts
+// sum to zero.
+func sboxesSumToZero(cb codebook, sets [][]byte) bool {
+	nr := newNibbleRelations()
+	for _, pts := range sets {
+		nr.add(cb, pts)
+	}
+
+	return nr[0].Len() <= 11 && nr[1].Len() <= 11
+}
+
+// invert returns the construction which computes the inverse permutation.
+func invert(constr spn.Construction) (out spn.Construction) {
+	for i := len(constr) - 1; i >= 0; i-- {
+		switch layer := constr[i].(type) {
+		case spn.SBoxLayer:
+			out = append(out, layer.Inverse())
+		case spn.AffineLayer:
+			out = append(out, layer.Inverse())
+		}
+	}
+
+	return
+}
+
+// smallStructures are the reduced structures that DecomposeSmallSPN supports.
+var smallStructures = map[spn.Structure]bool{
+	"A": true, "S": true, spn.AS: true, spn.SA: true, spn.ASA: true, spn.SAS: true, spn.ASAS: true, spn.SASA: true,
+	spn.ASASA: true, spn.SASAS: true, "ASASAS": true, "SASASA": true,
+}
+
+// DecomposeSmallSPN takes a small SPN with a specified structure as input, reads its entire codebook, and outputs a
+// functionally identical constructions/spn.SmallConstruction. Every reduced structure with up to six layers is
+// supported. It panics on longer structures, or if no decomposition is found.
+//
+// Structures up to SASAS are attacked with the same techniques as DecomposeSPN, except that with the full codebook
+// every set of plaintexts can be enumerated. ASASA and SASASA are attacked by trying every 4-dimensional subspace of
+// inputs until one is found that the first affine layer maps onto one S-box. ASAS and ASASAS are attacked through their
+// inverses.
+//
+// With only two S-boxes per layer, the attacks often have more than one solution. Each one is tried until the rest of
+// the cipher decomposes, and every decomposition is checked against the codebook. Random choices are read from
+// crypto/rand.Reader.
+func DecomposeSmallSPN(constr SmallConstruction, structure spn.Structure) spn.SmallConstruction {
+	out, err := DecomposeSmallSPNWithRand(rand.Reader, constr, structure)
+	if err != nil {
+		panic(err)
+	}
+
+	return out
+}
+
+// DecomposeSmallSPNWithRand is DecomposeSmallSPN with every random choice read from rand instead, which returns an error
+// rather than panicking. It returns ErrUnknownStructure on longer structures and ErrNoDecomposition if no decomposition
+// is found.
+func DecomposeSmallSPNWithRand(rand io.Reader, constr SmallConstruction, structure spn.Structure) (spn.SmallConstruction, error) {
+	if !smallStructures[structure.Reduce()] {
+		return nil, ErrUnknownStructure
+	}
+
+	cb := codebook{}
+	for x := range cb {
+		cb[x] = constr.Encrypt(byte(x))
+	}
+
+	out, ok := decomposeSmallSPN(rand, cb, structure)
+	if !ok {
+		return nil, ErrNoDecomposition
+	}
+
+	return spn.SmallConstruction(out), nil
+}
+
+// decomposeSmallSPN returns a construction with the given structure which computes cb, or false if it can't find one.
+// The structure must be supported.
+func decomposeSmallSPN(rand io.Reader, cb codebook, structure spn.Structure) (spn.Construction, bool) {
+	structure = structure.Reduce()
+
+	switch structure {
+	case "A":
+		columns, s := []byte{}, span8{}
+		for i := uint(0); i < 8; i++ {
+			columns = append(columns, cb[1<<i]^cb[0])
+			s.add(columns[i])
+		}
+
+		if s.dim() != 8 {
+			return nil, false
+		}
+
+		first := affineFromColumns(columns)
+		first.Constant = []byte{cb[0]}
+
+		return spn.Construction{first}, cb.peel(first) == identity()
+	case "S":
+		key0, key1 := make([]uint16, 16), make([]uint16, 16)
+		for v := 0; v < 16; v++ {
+			key0[v] = uint16(nibble(cb[v], 0))
+			key1[v] = uint16(nibble(cb[v<<4], 1))
+		}
+
+		for x := 0; x < 256; x++ {
+			if cb[x] != byte(key0[x&0x0f])|byte(key1[x>>4])<<4 {
+				return nil, false
+			}
+		}
+
+		return spn.Construction{spn.SBoxLayer{spn.NewSBox(key0), spn.NewSBox(key1)}}, true
+	case spn.ASAS, "ASASAS":
+		constr, ok := decomposeSmallSPN(rand, cb.inverse(), structure.Inverse())
+		return invert(constr), ok
+	case spn.ASASA, "SASASA":
+		balanced := sumsToZero
+		if structure[0] == byte(spn.Substitution) {
+			balanced = sboxesSumToZero
+		}
+
+		for _, first := range inputCandidates(cb, balanced) {
+			if rest, ok := decomposeSmallSPN(rand, cb.unpeel(first), structure[:len(structure)-1]); ok {
+				return append(spn.Construction{first}, rest...), true
+			}
+		}
+
+		return nil, false
+	}
+
+	cands := []spn.Layer{}
+
+	switch structure {
+	case spn.AS:
+		for _, last := range splits(trivialColumns(cb)) {
+			cands = append(cands, last)
+		}
+	case spn.ASA:
+		for _, last := range splits(differenceColumns(cb)) {
+			cands = append(cands, last)
+		}
+	case spn.SA:
+		for _, last := range sboxCandidates(rand, cb, balancedSets) {
+			cands = append(cands, last)
+		}
+	case spn.SAS:
+		for _, last := range sboxCandidates(rand, cb, dualSets) {
+			cands = append(cands, last)
+		}
+	case spn.SASA:
+		for _, last := range sboxCandidates(rand, cb, subspaceSets) {
+			cands = append(cands, last)
+		}
+	case spn.SASAS:
+		for _, last := range sboxCandidates(rand, cb, permutationSets) {
+			cands = append(cands, last)
+		}
+	default:
+		panic("Unknown SPN structure!")
+	}
+
+	for _, last := range cands {
+		if rest, ok := decomposeSmallSPN(rand, cb.peel(last), structure.Inner()); ok {
+			return append(rest, last), true
+		}
+	}
+
+	return nil, false
+}
@@ -1,4 +1,4 @@
-// Package spn implements a cryptanalysis of generic SPN block ciphers with 128-bit blocks and 8-bit S-boxes. See
+// Package spn implements a cryptanalysis of generic SPN block ciphers with 128-bit blocks and 4- or 8-bit S-boxes. See
 // constructions/spn for more information on the construction itself.
 //
 // It is based on Biryukov's multiset calculus. The main techniques are Cube Attacks (Dinur) and Low Rank Detection
@@ -13,6 +13,40 @@
 // cipher's internal state. We can then separate what has collided from what hasn't. Low Rank Detection is used for
 // removing trailing affine layers from the body of the SPN.
 //
+// ASASA has no trailing S-box layer to expose collisions with, so its trailing affine layer is found with the degree
+// deficiency of the last S-box layer instead: products of two output bits of the same S-box have lower degree than
+// products of output bits of different S-boxes. Summing products of output bits over cubes gives linear relations on
+// quadratic forms, whose solutions reveal which output bits belong to the same S-box.
+//
+// With 4-bit S-boxes, the input to the last S-box layer of SASASA has degree at most 9, so it sums to zero over cubes of
+// dimension 10 and the last S-box layer can be split off with a cube attack. If the cipher can also be queried in the
+// decryption direction, DecomposeTwoSidedSPN uses this to split the first S-box layer off of ASASAS, and generally peels
+// layers off of whichever end is cheaper. With 8-bit S-boxes, the cubes for ASASA and SASASA have 2^50
+// plaintexts, so neither ASASA nor ASASAS can be broken even with both oracles.
+//
+// So ASASA is only supported with 4-bit S-boxes, and only when its last S-box layer has at most one affine component:
+// an affine component makes products with other S-boxes' outputs vanish too, and only one can be set aside before
+// splitting. About a third of random 4-bit S-box layers have more, and fail with ErrAffineComponents. 8-bit S-boxes essentially never have affine
+// components, but fail with ErrUnsupportedParams because of the size of the cubes.
+//
+// If the structure isn't known, IdentifyStructure recognizes it from the same properties the attacks rely on: which sets
+// of plaintexts sum to zero, at the output or at the input to the last S-box layer.
+//
+// Long decompositions report their progress--each stage starting and finishing, and how close it is to what it needs--to
+// an Observer attached to their context with WithObserver. JSONReporter writes these events as lines of JSON.
+//
+// An Attacker runs the same attacks with Options that change how many attempts each stage makes before giving up, and
+// which plaintexts the cube attack uses for each structure, to trade queries against the chance of success.
+//
+// constructions/spn also generates SPNs with other S-box widths, like 6 and 16 bits, but they can't be attacked. 6-bit
+// S-boxes don't evenly divide a 128-bit block, so they only come with other block sizes, which none of the attacks
+// handle. For 16-bit S-boxes, the cube attack needs about 2^16 sets of 2^16 plaintexts to pin down each S-box, and there
+// are far too many candidates to search for it in the relations' solutions. Every attack returns ErrUnsupportedParams
+// for them before making any queries.
+//
+// Small SPNs, with 8-bit blocks and 4-bit S-boxes, are decomposed from their full codebook by DecomposeSmallSPN. The
+// codebook is small enough to also enumerate every candidate for the first affine layer, which reaches six layers.
+//
 // "Structural Cryptanalysis of SASAS" by Alex Biryukov and Adi Shamir,
 // https://www.iacr.org/archive/eurocrypt2001/20450392.pdf
 //
@@ -21,22 +55,52 @@
 //
 // "Cube Attacks on Tweakable Black Box Polynomials" by Itai Dinur and Adi Shamir,
 // https://eprint.iacr.org/2008/385.pdf
+//
+// "Key-Recovery Attacks on ASASA" by Brice Minaud, Patrick Derbez, Pierre-Alain Fouque, and Pierre Karpman,
+// https://eprint.iacr.org/2015/516.pdf
+//
+// "Decomposing the ASASA Block Cipher Construction" by Itai Dinur, Orr Dunkelman, Thorsten Kranz, and Gregor Leander,
+// https://eprint.iacr.org/2015/507.pdf
 package spn
 
 import (
+	"context"
+	"crypto/rand"
+	"io"
+
 	"github.com/OpenWhiteBox/primitives/encoding"
 
 	"github.com/OpenWhiteBox/Generic/constructions/spn"
+	"github.com/OpenWhiteBox/Generic/internal/gf2"
 )
 
 // Construction represents an implementation of an SPN block cipher. The implementation doesn't assume that this is a
 // constructions/spn.Construction for generality, and the cryptanalysis doesn't assume that you have access to Encrypt
-// AND Decrypt--access to either allows you to break it.
+// AND Decrypt--access to either allows you to break it. See Decrypter for the other half.
 type Construction interface {
 	Encrypt([]byte, []byte)
 }
 
-// Encoding implements encoding.Block over a Construction to make some code simpler. Decode can not be called.
+// Decrypter represents an implementation of an SPN block cipher which only exposes decryption.
+type Decrypter interface {
+	Decrypt([]byte, []byte)
+}
+
+// Decryption implements Construction over a Decrypter, so that the inverse cipher can be attacked like any other.
+type Decryption struct{ Decrypter }
+
+func (d Decryption) Encrypt(dst, src []byte) {
+	d.Decrypter.Decrypt(dst, src)
+}
+
+// Cipher represents an implementation of an SPN block cipher which can be queried in both directions.
+type Cipher interface {
+	Construction
+	Decrypter
+}
+
+// Encoding implements encoding.Block over a Construction to make some code simpler. Decode can only be called if the
+// Construction is also a Decrypter.
 type Encoding struct{ Construction }
 
 func (e Encoding) Encode(in [16]byte) (out [16]byte) {
@@ -45,43 +109,353 @@ func (e Encoding) Encode(in [16]byte) (out [16]byte) {
 }
 
 func (e Encoding) Decode(in [16]byte) (out [16]byte) {
-	panic("cryptanalysis/spn.Encoding.Decode should never be called!")
+	d, ok := e.Construction.(Decrypter)
+	if !ok {
+		panic("cryptanalysis/spn.Encoding.Decode should never be called without a Decrypter!")
+	}
+
+	d.Decrypt(out[:], in[:])
+	return
 }
 
 // DecomposeSPN takes a Construction with a specified structure as input and outputs a functionally identical
-// constructions/spn.Construction, with which you can Encrypt, Decrypt, inspect internal constants, etc.
+// constructions/spn.Construction, with which you can Encrypt, Decrypt, inspect internal constants, etc. Consecutive
+// layers of the same type are treated as one layer, so AAS is decomposed as AS. It panics if no attack on the reduced
+// structure is known or the attack fails. Random choices are read from crypto/rand.Reader.
+//
+// The layers are only recovered up to affine maps on each S-box's input and output and the order of the S-boxes.
+// spn.Relate finds those maps when the original construction is known.
+//
+// ASASA and SASASA aren't supported with the default 8-bit S-boxes: their attacks would sum over cubes of 2^50
+// plaintexts, so DecomposeSPN always panics on them. Use DecomposeSPNWithParams with 4-bit S-boxes instead. Even then,
+// ASASA is only supported when its last S-box layer has at most one affine component, and fails with
+// ErrAffineComponents otherwise, which happens to about a third of random ones.
 func DecomposeSPN(constr Construction, structure spn.Structure) (out spn.Construction) {
-	cipher := Encoding{constr}
-	return decomposeSPN(cipher, structure)
+	return DecomposeSPNWithParams(constr, structure, spn.DefaultParams)
+}
+
+// DecomposeSPNWithParams is DecomposeSPN for SPNs with the given dimensions. The block size must be 128 bits and the
+// S-boxes must be 4 or 8 bits wide. Any other dimensions, including 6- and 16-bit S-boxes, fail with
+// ErrUnsupportedParams.
+func DecomposeSPNWithParams(constr Construction, structure spn.Structure, params spn.Params) (out spn.Construction) {
+	out, err := DecomposeSPNWithRand(rand.Reader, constr, structure, params)
+	if err != nil {
+		panic(err)
+	}
+
+	return out
+}
+
+// DecomposeSPNWithRand is DecomposeSPNWithParams with every random choice read from rand instead, which returns an error
+// rather than panicking. Given the same construction and a random source that returns the same bytes, it makes the same
+// queries and returns the same result, so a failed run can be reproduced by seeding rand.
+//
+// It returns ErrUnsupportedParams or ErrUnknownStructure if the attack can't be run, and a *StageError if a stage of the
+// attack fails or constr is an Oracle whose budget runs out. It still panics if rand fails.
+func DecomposeSPNWithRand(rand io.Reader, constr Construction, structure spn.Structure, params spn.Params) (out spn.Construction, err error) {
+	return DecomposeSPNWithContext(context.Background(), rand, constr, structure, params, 1)
+}
+
+// DecomposeSPNWithContext is DecomposeSPNWithRand, except that it gives up once ctx is done, returning ctx's error in a
+// *StageError, and spreads the queries and linear algebra of each stage across up to workers goroutines. constr must be
+// safe for concurrent use if workers is more than one. The result only depends on rand and workers, not on how the
+// goroutines are scheduled. To also limit the number of queries, pass an Oracle as constr. To follow the attack's
+// progress, attach an Observer to ctx with WithObserver. To change how many attempts each stage makes, use an Attacker.
+func DecomposeSPNWithContext(ctx context.Context, rand io.Reader, constr Construction, structure spn.Structure, params spn.Params, workers int) (spn.Construction, error) {
+	return NewAttacker(Options{Workers: workers}).DecomposeSPN(ctx, rand, constr, structure, params)
+}
+
+// DecomposeSPNWithBudget is DecomposeSPNWithRand, except that it stops after budget queries to constr (or never, if
+// budget is zero) and also returns the number of queries each stage made.
+func DecomposeSPNWithBudget(rand io.Reader, constr Construction, structure spn.Structure, params spn.Params, budget int) (spn.Construction, []StageQueries, error) {
+	oracle := NewOracle(constr, budget)
+	out, err := DecomposeSPNWithRand(rand, oracle, structure, params)
+
+	return out, oracle.Report(), err
+}
+
+// DecomposeInverseSPN is DecomposeSPN for a cipher which can only be queried in the decryption direction. It decomposes
+// the inverse cipher, whose structure is structure.Inverse(), and inverts the result, so it can break every structure
+// whose inverse DecomposeSPN can. For example, SASA is broken by attacking ASAS.
+func DecomposeInverseSPN(constr Decrypter, structure spn.Structure) (out spn.Construction) {
+	return DecomposeInverseSPNWithParams(constr, structure, spn.DefaultParams)
+}
+
+// DecomposeInverseSPNWithParams is DecomposeInverseSPN for SPNs with the given dimensions.
+func DecomposeInverseSPNWithParams(constr Decrypter, structure spn.Structure, params spn.Params) (out spn.Construction) {
+	out, err := DecomposeInverseSPNWithRand(rand.Reader, constr, structure, params)
+	if err != nil {
+		panic(err)
+	}
+
+	return out
+}
+
+// DecomposeInverseSPNWithRand is DecomposeSPNWithRand for a Decrypter. Layers in a *StageError are counted in the order
+// they're applied to the input of the inverse cipher.
+func DecomposeInverseSPNWithRand(rand io.Reader, constr Decrypter, structure spn.Structure, params spn.Params) (spn.Construction, error) {
+	return DecomposeInverseSPNWithContext(context.Background(), rand, constr, structure, params, 1)
+}
+
+// DecomposeInverseSPNWithContext is DecomposeSPNWithContext for a Decrypter.
+func DecomposeInverseSPNWithContext(ctx context.Context, rand io.Reader, constr Decrypter, structure spn.Structure, params spn.Params, workers int) (spn.Construction, error) {
+	return NewAttacker(Options{Workers: workers}).DecomposeInverseSPN(ctx, rand, constr, structure, params)
+}
+
+// DecomposeInverseSPNWithBudget is DecomposeSPNWithBudget for a Decrypter.
+func DecomposeInverseSPNWithBudget(rand io.Reader, constr Decrypter, structure spn.Structure, params spn.Params, budget int) (spn.Construction, []StageQueries, error) {
+	oracle := NewOracle(Decryption{constr}, budget)
+	out, err := NewAttacker(DefaultOptions).decomposeInverseSPN(context.Background(), rand, oracle, structure, params)
+
+	return out, oracle.Report(), err
+}
+
+// DecomposeTwoSidedSPN is DecomposeSPN for a cipher which can be queried in both directions. It peels layers off of
+// whichever end of the cipher is cheapest to attack, which takes fewer queries than DecomposeSPN on AS and ASAS, and
+// also breaks ASASAS with 4-bit S-boxes by first peeling its leading S-box layer off in the decryption direction.
+func DecomposeTwoSidedSPN(constr Cipher, structure spn.Structure) (out spn.Construction) {
+	return DecomposeTwoSidedSPNWithParams(constr, structure, spn.DefaultParams)
+}
+
+// DecomposeTwoSidedSPNWithParams is DecomposeTwoSidedSPN for SPNs with the given dimensions.
+func DecomposeTwoSidedSPNWithParams(constr Cipher, structure spn.Structure, params spn.Params) (out spn.Construction) {
+	out, err := DecomposeTwoSidedSPNWithRand(rand.Reader, constr, structure, params)
+	if err != nil {
+		panic(err)
+	}
+
+	return out
+}
+
+// DecomposeTwoSidedSPNWithRand is DecomposeSPNWithRand for a Cipher.
+func DecomposeTwoSidedSPNWithRand(rand io.Reader, constr Cipher, structure spn.Structure, params spn.Params) (out spn.Construction, err error) {
+	return DecomposeTwoSidedSPNWithContext(context.Background(), rand, constr, structure, params, 1)
+}
+
+// DecomposeTwoSidedSPNWithContext is DecomposeSPNWithContext for a Cipher.
+func DecomposeTwoSidedSPNWithContext(ctx context.Context, rand io.Reader, constr Cipher, structure spn.Structure, params spn.Params, workers int) (spn.Construction, error) {
+	return NewAttacker(Options{Workers: workers}).DecomposeTwoSidedSPN(ctx, rand, constr, structure, params)
+}
+
+// DecomposeTwoSidedSPNWithBudget is DecomposeSPNWithBudget for a Cipher. Queries in both directions count against the
+// same budget.
+func DecomposeTwoSidedSPNWithBudget(rand io.Reader, constr Cipher, structure spn.Structure, params spn.Params, budget int) (spn.Construction, []StageQueries, error) {
+	oracle := NewOracle(constr, budget)
+	out, err := DecomposeTwoSidedSPNWithRand(rand, oracle, structure, params)
+
+	return out, oracle.Report(), err
+}
+
+// attack runs run against constr, wrapped in an Oracle if it isn't one already, and returns the Oracle's budget running
+// out as a *StageError. ctx's observer, if it has one, is tracked through the Oracle.
+func attack(ctx context.Context, constr Construction, run func(ctx context.Context, oracle *Oracle) error) (err error) {
+	oracle, ok := constr.(*Oracle)
+	if !ok {
+		oracle = NewOracle(constr, 0)
+	}
+	ctx = track(ctx, oracle)
+
+	defer func() {
+		if r := recover(); r != nil {
+			if r != ErrBudgetExceeded {
+				panic(r)
+			}
+
+			current := oracle.current()
+			err = &StageError{current.Stage, current.Layer, 0, ErrBudgetExceeded}
+			endStage(ctx, oracle, err)
+		}
+	}()
+
+	return run(ctx, oracle)
+}
+
+// decomposeSBoxes recovers a cipher which is a single layer of width-bit S-boxes by querying each S-box on every input.
+func decomposeSBoxes(cipher encoding.Block, width int) (out spn.SBoxLayer) {
+	for pos := 0; pos < 128/width; pos++ {
+		key := make([]uint16, 1<<uint(width))
+
+		for x := range key {
+			pt := [16]byte{}
+			gf2.SetChunk(pt[:], pos*width, width, uint16(x))
+
+			ct := cipher.Encode(pt)
+			key[x] = gf2.GetChunk(ct[:], pos*width, width)
+		}
+
+		out = append(out, spn.NewSBox(key))
+	}
+
+	return
+}
+
+// decomposeLayer recovers a cipher which is a single layer of the given type, numbered layer.
+func decomposeLayer(ctx context.Context, oracle *Oracle, cipher encoding.Block, structure spn.Structure, width, layer int) (out spn.Layer) {
+	if structure == "A" {
+		beginStage(ctx, oracle, AffineDecomposition, layer, "")
+		first, _ := encoding.DecomposeBlockAffine(cipher)
+		out = spn.FromBlock(first)
+	} else {
+		beginStage(ctx, oracle, SBoxDecomposition, layer, "")
+		out = decomposeSBoxes(cipher, width)
+	}
+
+	endStage(ctx, oracle, nil)
+	return out
+}
+
+// peelable are the reduced structures whose last layer peel can recover.
+var peelable = map[spn.Structure]bool{
+	spn.AS: true, spn.SA: true, spn.ASA: true, spn.SAS: true, spn.ASAS: true, spn.SASA: true, spn.ASASA: true,
+	spn.SASAS: true, "SASASA": true,
+}
+
+// peelBackwards returns whether decomposeTwoSidedSPN peels the first layer of the reduced structure, by attacking the
+// inverse cipher, rather than the last.
+func peelBackwards(structure spn.Structure) bool {
+	inverse := structure.Inverse()
+	return peelable[inverse] && (!peelable[structure] || structure.Outer() == spn.Affine && inverse.Outer() == spn.Substitution)
+}
+
+// supported returns an error if some layer of structure can't be peeled with width-bit S-boxes, so that an attack which
+// can't finish fails before it makes any queries. If twoSided is true, layers are peeled the way decomposeTwoSidedSPN
+// peels them.
+func (a *Attacker) supported(structure spn.Structure, width int, twoSided bool) error {
+	for structure = structure.Reduce(); len(structure) > 1; {
+		backwards := twoSided && peelBackwards(structure)
+		if backwards {
+			structure = structure.Inverse()
+		}
+
+		if !peelable[structure] {
+			return ErrUnknownStructure
+		} else if a.peelCubeDimension(structure, width) > maxCubeDimension {
+			return ErrUnsupportedParams
+		}
+
+		if backwards {
+			structure = structure.Inner().Inverse()
+		} else {
+			structure = structure.Inner()
+		}
+	}
+
+	return nil
+}
+
+// peelCubeDimension returns the dimension of the cubes that peel sums over to recover the last layer of structure, or
+// zero if it doesn't sum over cubes.
+func (a *Attacker) peelCubeDimension(structure spn.Structure, width int) int {
+	switch structure {
+	case spn.ASASA:
+		return cubeDimension(width)
+	case "SASASA":
+		if _, ok := a.opts.Generators[structure]; !ok {
+			return cubeDimension(width)
+		}
+	}
+
+	return 0
 }
 
-func decomposeSPN(cipher encoding.Block, structure spn.Structure) (out spn.Construction) {
+// peel recovers the last layer of cipher, which has the given reduced structure, and returns it along with the rest of
+// the cipher. Queries are made through oracle, which is told which stage each query belongs to, and the layer is
+// numbered layer.
+func (a *Attacker) peel(ctx context.Context, rand io.Reader, oracle *Oracle, cipher encoding.Block, structure spn.Structure, width, layer int) (last spn.Layer, rest encoding.Block, err error) {
+	recoverAffine := func(stage Stage, name string, generator SubspaceGenerator) {
+		beginStage(ctx, oracle, stage, layer, name)
+
+		var affine encoding.BlockAffine
+		affine, rest, err = a.RecoverAffine(ctx, rand, cipher, width, generator)
+		last = spn.FromBlock(affine)
+	}
+
+	recoverSBoxes := func(name string, generator Generator) {
+		beginStage(ctx, oracle, CubeAttack, layer, name)
+		last, rest, err = a.RecoverSBoxes(ctx, rand, cipher, width, generator)
+	}
+
 	switch structure {
 	case spn.AS:
-		last, rest := RecoverAffine(cipher, trivialSubspaces)
-		first := encoding.DecomposeConcatenatedBlock(rest)
-		return spn.Construction(encoding.ComposedBlocks{first, last})
-	case spn.SA:
-		last, rest := RecoverSBoxes(cipher, BalancedPlaintexts(4))
-		first, _ := encoding.DecomposeBlockAffine(rest)
-		return spn.Construction(encoding.ComposedBlocks{first, last})
+		recoverAffine(TrivialSubspaces, "", a.trivialSubspaces)
 	case spn.ASA:
-		last, rest := RecoverAffine(cipher, lowRankDetectionWith(nextByAddition))
-		return append(decomposeSPN(rest, spn.SA), last)
-	case spn.SAS:
-		last, rest := RecoverSBoxes(cipher, DualPlaintexts(4))
-		return append(decomposeSPN(rest, spn.AS), last)
+		recoverAffine(LowRankDetection, "next by addition", a.lowRankDetectionWith(nextByAddition))
 	case spn.ASAS:
-		last, rest := RecoverAffine(cipher, lowRankDetectionWith(nextByToggle))
-		return append(decomposeSPN(rest, spn.SAS), last)
-	case spn.SASA:
-		last, rest := RecoverSBoxes(cipher, PermutationPlaintexts(256))
-		return append(decomposeSPN(rest, spn.ASA), last)
-	// case spn.ASASA:
-	case spn.SASAS:
-		last, rest := RecoverSBoxes(cipher, PermutationPlaintexts(256))
-		return append(decomposeSPN(rest, spn.ASAS), last)
+		recoverAffine(LowRankDetection, "next by toggle", a.lowRankDetectionWith(nextByToggle))
+	case spn.ASASA:
+		recoverAffine(QuadraticSubspaces, "", a.quadraticSubspaces)
+	case spn.SA, spn.SAS, spn.SASA, spn.SASAS, "SASASA":
+		recoverSBoxes(a.cubeGenerator(structure, width))
 	default:
-		panic("Unknown SPN structure!")
+		return nil, nil, ErrUnknownStructure
+	}
+
+	if err == ErrBudgetExceeded {
+		err = &StageError{oracle.current().Stage, layer, 0, err}
+	} else if se, ok := err.(*StageError); ok {
+		se.Layer = layer
+	}
+	endStage(ctx, oracle, err)
+
+	return
+}
+
+// decomposeSPN recovers the layers of cipher one at a time, starting with the last. Queries are made through oracle,
+// which is told which stage each query belongs to.
+func (a *Attacker) decomposeSPN(ctx context.Context, rand io.Reader, oracle *Oracle, cipher encoding.Block, structure spn.Structure, width int) (spn.Construction, error) {
+	structure = structure.Reduce()
+	layer := len(structure) - 1
+
+	if len(structure) == 1 {
+		return spn.Construction{decomposeLayer(ctx, oracle, cipher, structure, width, layer)}, nil
+	}
+
+	last, rest, err := a.peel(ctx, rand, oracle, cipher, structure, width, layer)
+	if err != nil {
+		return nil, err
 	}
+
+	out, err := a.decomposeSPN(ctx, rand, oracle, rest, structure.Inner(), width)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(out, last), nil
+}
+
+// decomposeTwoSidedSPN recovers the layers of cipher one at a time, from either end. It prefers to peel an S-box layer,
+// because the cube attack needs far fewer queries than recovering an affine layer, and peels the first layer by
+// attacking the inverse cipher. The first layer is numbered first.
+func (a *Attacker) decomposeTwoSidedSPN(ctx context.Context, rand io.Reader, oracle *Oracle, cipher encoding.Block, structure spn.Structure, width, first int) (spn.Construction, error) {
+	if len(structure) == 1 {
+		return spn.Construction{decomposeLayer(ctx, oracle, cipher, structure, width, first)}, nil
+	}
+
+	if !peelBackwards(structure) {
+		last, rest, err := a.peel(ctx, rand, oracle, cipher, structure, width, first+len(structure)-1)
+		if err != nil {
+			return nil, err
+		}
+
+		out, err := a.decomposeTwoSidedSPN(ctx, rand, oracle, rest, structure.Inner(), width, first)
+		if err != nil {
+			return nil, err
+		}
+
+		return append(out, last), nil
+	}
+
+	// The last layer of the inverse cipher undoes the first layer of the cipher.
+	inverse := structure.Inverse()
+	last, rest, err := a.peel(ctx, rand, oracle, encoding.InverseBlock{cipher}, inverse, width, first)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := a.decomposeTwoSidedSPN(ctx, rand, oracle, encoding.InverseBlock{rest}, inverse.Inner().Inverse(), width, first+1)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(invert(spn.Construction{last}), out...), nil
 }
@@ -1,12 +1,19 @@
 package spn
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"testing"
 
 	"crypto/rand"
+	mrand "math/rand"
 
 	"github.com/OpenWhiteBox/primitives/encoding"
+	"github.com/OpenWhiteBox/primitives/gfmatrix"
 
 	"github.com/OpenWhiteBox/Generic/constructions/spn"
 )
@@ -79,6 +86,31 @@ func TestDecomposeSAS(t *testing.T) {
 	if !ok {
 		t.Fatal("Incorrectly decomposed SAS structure!")
 	}
+
+	canonical1, err := constr1.Canonical()
+	if err != nil {
+		t.Fatal(err)
+	}
+	canonical2, err := constr2.Canonical()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serialized1, _ := canonical1.Serialize()
+	serialized2, _ := canonical2.Serialize()
+	if !bytes.Equal(serialized1, serialized2) {
+		t.Fatal("Decomposed SAS structure has a different canonical form!")
+	}
+
+	if ok, in, err := spn.Equivalent(constr1, constr2); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatalf("Decomposed SAS structure differs on input %x!", in)
+	}
+
+	if _, err := spn.Relate(constr1, constr2); err != nil {
+		t.Fatalf("Couldn't relate decomposed SAS structure to the original: %v", err)
+	}
 }
 
 func TestDecomposeASAS(t *testing.T) {
@@ -93,6 +125,12 @@ func TestDecomposeASAS(t *testing.T) {
 	if !ok {
 		t.Fatal("Incorrectly decomposed ASAS structure!")
 	}
+
+	if ok, in, err := spn.Equivalent(constr1, constr2); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatalf("Decomposed ASAS structure differs on input %x!", in)
+	}
 }
 
 func TestDecomposeSASA(t *testing.T) {
@@ -110,7 +148,162 @@ func TestDecomposeSASA(t *testing.T) {
 }
 
 func TestDecomposeASASA(t *testing.T) {
-	t.Skip()
+	if testing.Short() {
+		t.Skip("ASASA decomposition needs millions of queries.")
+	}
+
+	// With 8-bit S-boxes, the attack sums over cubes of dimension 50, so test with 4-bit S-boxes instead. ASASA is only
+	// supported when the last S-box layer has at most one affine component, so redraw S-boxes there until it does.
+	params := spn.Params{BlockSize: 16, SBoxSize: 4}
+
+	constr1 := spn.NewSPNWithParams(rand.Reader, spn.ASASA, params)
+	sboxes, n := constr1[3].(spn.SBoxLayer), 0
+	for i := range sboxes {
+		for n+affineComponents(sboxes[i]) > 1 {
+			sboxes[i] = spn.GenerateSBox(rand.Reader, params.SBoxSize)
+		}
+		n += affineComponents(sboxes[i])
+	}
+
+	constr2, err := NewAttacker(DefaultOptions).DecomposeSPN(context.Background(), rand.Reader, constr1, spn.ASASA, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok := encoding.ProbablyEquivalentBlocks(
+		Encoding{constr1},
+		Encoding{constr2},
+	)
+
+	if !ok {
+		t.Fatal("Incorrectly decomposed ASASA structure!")
+	}
+}
+
+// affineComponents returns the number of independent linear combinations of an S-box's output bits which are affine
+// functions of its input.
+func affineComponents(sbox spn.SBox) (n int) {
+	size, masks := len(sbox.EncKey), 0
+
+	for mask := 1; mask < size; mask++ {
+		f := func(x int) (out int) {
+			for y := int(sbox.Encode(uint16(x))) & mask; y > 0; y &= y - 1 {
+				out ^= 1
+			}
+			return
+		}
+
+		affine := true
+		for x := 0; x < size && affine; x++ {
+			y := f(0)
+			for bit := 1; bit < size; bit <<= 1 {
+				if x&bit != 0 {
+					y ^= f(bit) ^ f(0)
+				}
+			}
+
+			affine = y == f(x)
+		}
+
+		if affine {
+			masks++
+		}
+	}
+
+	// The affine masks and zero form a subspace with 2^n elements.
+	for ; masks > 0; masks >>= 1 {
+		n++
+	}
+
+	return
+}
+
+// expectedNibbleFailure returns true if err is one of the documented failures of the attacks on random 4-bit S-boxes,
+// and fails the test if constr doesn't have the affine components that the failure blames.
+func expectedNibbleFailure(t *testing.T, constr spn.Construction, err error) bool {
+	se, ok := err.(*StageError)
+	if !ok {
+		return false
+	}
+
+	switch {
+	case se.Stage == QuadraticSubspaces && se.Err == ErrAffineComponents:
+		n := 0
+		for i := len(constr) - 1; n == 0 && i >= 0; i-- {
+			if sboxes, ok := constr[i].(spn.SBoxLayer); ok {
+				for _, sbox := range sboxes {
+					n += affineComponents(sbox)
+				}
+				break
+			}
+		}
+
+		if n < 2 {
+			t.Fatalf("Blamed affine components for %v, but the last S-box layer only has %v!", err, n)
+		}
+		t.Logf("Last S-box layer has %v affine components: %v", n, err)
+
+		return true
+	case se.Stage == LowRankDetection && se.Err == ErrNearCollisions:
+		// Near-collisions only outnumber the true subspaces when at least two S-boxes next to the affine layer have
+		// affine components.
+		boxes := 0
+		for _, i := range []int{se.Layer - 1, se.Layer + 1} {
+			if sboxes, ok := layerAt(constr, i).(spn.SBoxLayer); ok {
+				n := 0
+				for _, sbox := range sboxes {
+					if affineComponents(sbox) > 0 {
+						n++
+					}
+				}
+				if n > boxes {
+					boxes = n
+				}
+			}
+		}
+
+		if boxes < 2 {
+			t.Fatalf("Blamed near-collisions for %v, but only %v S-boxes have affine components!", err, boxes)
+		}
+		t.Logf("%v S-boxes have affine components: %v", boxes, err)
+
+		return true
+	}
+
+	return false
+}
+
+// layerAt returns constr[i], or nil if i is out of range.
+func layerAt(constr spn.Construction, i int) spn.Layer {
+	if i < 0 || i >= len(constr) {
+		return nil
+	}
+
+	return constr[i]
+}
+
+func TestDecomposeNibbles(t *testing.T) {
+	params := spn.Params{BlockSize: 16, SBoxSize: 4}
+	attacker := NewAttacker(DefaultOptions)
+
+	for _, structure := range []spn.Structure{spn.AS, spn.SA, spn.ASA, spn.SAS, spn.ASAS, spn.SASA, spn.SASAS} {
+		constr1 := spn.NewSPNWithParams(rand.Reader, structure, params)
+		constr2, err := attacker.DecomposeSPN(context.Background(), rand.Reader, constr1, structure, params)
+		if expectedNibbleFailure(t, constr1, err) {
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		ok := encoding.ProbablyEquivalentBlocks(
+			Encoding{constr1},
+			Encoding{constr2},
+		)
+
+		if !ok {
+			t.Fatalf("Incorrectly decomposed %v structure with 4-bit S-boxes!", structure)
+		}
+	}
 }
 
 func TestDecomposeSASAS(t *testing.T) {
@@ -126,3 +319,536 @@ func TestDecomposeSASAS(t *testing.T) {
 		t.Fatal("Incorrectly decomposed SASAS structure!")
 	}
 }
+
+// decryptOnly hides everything but a cipher's Decrypt method.
+type decryptOnly struct{ Decrypter }
+
+func TestDecomposeInverse(t *testing.T) {
+	constr1 := spn.NewSPN(rand.Reader, spn.SASA)
+	constr2, report, err := DecomposeInverseSPNWithBudget(rand.Reader, decryptOnly{constr1}, spn.SASA, spn.DefaultParams, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok := encoding.ProbablyEquivalentBlocks(
+		Encoding{constr1},
+		Encoding{constr2},
+	)
+	if !ok {
+		t.Fatal("Incorrectly decomposed SASA structure from its decryption oracle!")
+	}
+
+	if constr2.Structure() != spn.SASA {
+		t.Fatalf("Decomposition has structure %v!", constr2.Structure())
+	}
+
+	if len(report) == 0 || report[0].Stage != LowRankDetection {
+		t.Fatalf("Wrong stages in query report: %v", report)
+	}
+}
+
+func TestDecomposeTwoSided(t *testing.T) {
+	for _, structure := range []spn.Structure{spn.AS, spn.ASAS} {
+		constr1 := spn.NewSPN(rand.Reader, structure)
+		constr2, report, err := DecomposeTwoSidedSPNWithBudget(rand.Reader, constr1, structure, spn.DefaultParams, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ok := encoding.ProbablyEquivalentBlocks(
+			Encoding{constr1},
+			Encoding{constr2},
+		)
+		if !ok {
+			t.Fatalf("Incorrectly decomposed %v structure from both sides!", structure)
+		}
+
+		// The leading S-box layer is cheaper to split off than the trailing affine layer.
+		if report[0].Stage != CubeAttack || report[0].Layer != 0 {
+			t.Fatalf("Wrong stages in query report: %v", report)
+		}
+	}
+}
+
+func TestDecomposeASASAS(t *testing.T) {
+	if testing.Short() {
+		t.Skip("ASASAS decomposition needs millions of queries.")
+	}
+
+	params := spn.Params{BlockSize: 16, SBoxSize: 4}
+
+	constr1 := spn.NewSPNWithParams(rand.Reader, "ASASAS", params)
+	constr2, err := NewAttacker(DefaultOptions).DecomposeTwoSidedSPN(context.Background(), rand.Reader, constr1, "ASASAS", params)
+	if expectedNibbleFailure(t, constr1, err) {
+		return
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	ok := encoding.ProbablyEquivalentBlocks(
+		Encoding{constr1},
+		Encoding{constr2},
+	)
+	if !ok {
+		t.Fatal("Incorrectly decomposed ASASAS structure!")
+	}
+}
+
+func TestIdentifyStructure(t *testing.T) {
+	attacker := NewAttacker(DefaultOptions)
+
+	for _, structure := range []spn.Structure{"A", "S", spn.AS, spn.SA, spn.ASA, spn.SAS, spn.ASAS, spn.SASA, spn.SASAS} {
+		id, err := attacker.IdentifyStructure(context.Background(), rand.Reader, spn.NewSPN(rand.Reader, structure), spn.DefaultParams)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if id.Structure != structure || len(id.Candidates) != 1 || id.Confidence < 0.99 {
+			t.Fatalf("Identified %v structure as %v!", structure, id)
+		}
+	}
+
+	// With 8-bit S-boxes, every structure longer than SASAS looks the same.
+	id, err := attacker.IdentifyStructure(context.Background(), rand.Reader, spn.NewSPN(rand.Reader, spn.ASASA), spn.DefaultParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(id.Candidates) != 3 || id.Structure != spn.ASASA {
+		t.Fatalf("Identified ASASA structure as %v!", id)
+	}
+
+	params := spn.Params{BlockSize: 16, SBoxSize: 4}
+
+	for _, structure := range []spn.Structure{spn.ASASA, "ASASAS", "SASASA"} {
+		id, err := attacker.IdentifyStructure(context.Background(), rand.Reader, spn.NewSPNWithParams(rand.Reader, structure, params), params)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if id.Structure != structure || len(id.Candidates) != 1 {
+			t.Fatalf("Identified %v structure with 4-bit S-boxes as %v!", structure, id)
+		}
+	}
+}
+
+func TestDecomposeUnknown(t *testing.T) {
+	attacker := NewAttacker(DefaultOptions)
+
+	constr1 := spn.NewSPN(rand.Reader, spn.SAS)
+	constr2, id, err := attacker.DecomposeUnknownSPN(context.Background(), rand.Reader, constr1, spn.DefaultParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id.Structure != spn.SAS {
+		t.Fatalf("Identified SAS structure as %v!", id)
+	}
+
+	ok := encoding.ProbablyEquivalentBlocks(
+		Encoding{constr1},
+		Encoding{constr2},
+	)
+	if !ok {
+		t.Fatal("Incorrectly decomposed SAS structure of unknown structure!")
+	}
+
+	_, id, err = attacker.DecomposeUnknownSPN(context.Background(), rand.Reader, spn.NewSPN(rand.Reader, "SASASA"), spn.DefaultParams)
+	if err != ErrAmbiguousStructure {
+		t.Fatalf("Expected ErrAmbiguousStructure, got %v (%v)", err, id)
+	}
+}
+
+func TestDecomposeSmall(t *testing.T) {
+	structures := []spn.Structure{
+		spn.AS, spn.SA, spn.ASA, spn.SAS, spn.ASAS, spn.SASA, spn.SASAS, spn.ASASA, "SASASA", "ASASAS",
+	}
+
+	for _, structure := range structures {
+		if testing.Short() && len(structure) > 5 {
+			continue
+		}
+
+		constr1 := spn.NewSmallSPN(rand.Reader, structure)
+		constr2 := DecomposeSmallSPN(constr1, structure)
+
+		for x := 0; x < 256; x++ {
+			if constr1.Encrypt(byte(x)) != constr2.Encrypt(byte(x)) {
+				t.Fatalf("Incorrectly decomposed small %v structure!", structure)
+			}
+		}
+
+		if constr2.Structure().Reduce() != structure {
+			t.Fatalf("Decomposition of small %v structure has structure %v!", structure, constr2.Structure())
+		}
+	}
+}
+
+func TestDecomposeSeeded(t *testing.T) {
+	constr := spn.NewSmallSPN(rand.Reader, spn.SASAS)
+
+	decompose := func() []byte {
+		out, err := DecomposeSmallSPNWithRand(mrand.New(mrand.NewSource(1)), constr, spn.SASAS)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		serialized, err := out.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return serialized
+	}
+
+	if !bytes.Equal(decompose(), decompose()) {
+		t.Fatal("Decompositions with the same seed were different!")
+	}
+}
+
+func TestDecomposeParallel(t *testing.T) {
+	constr := spn.NewSPN(rand.Reader, spn.ASA)
+
+	decompose := func() []byte {
+		out, err := NewAttacker(Options{Workers: 4}).DecomposeSPN(context.Background(), mrand.New(mrand.NewSource(1)), constr, spn.ASA, spn.DefaultParams)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ok := encoding.ProbablyEquivalentBlocks(
+			Encoding{constr},
+			Encoding{out},
+		)
+		if !ok {
+			t.Fatal("Incorrectly decomposed ASA structure with several workers!")
+		}
+
+		serialized, err := out.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return serialized
+	}
+
+	if !bytes.Equal(decompose(), decompose()) {
+		t.Fatal("Decompositions with the same seed and workers were different!")
+	}
+}
+
+func TestRecoverAffine(t *testing.T) {
+	constr := spn.NewSPN(rand.Reader, spn.ASA)
+	attacker := NewAttacker(DefaultOptions)
+	generator := attacker.lowRankDetectionWith(nextByAddition)
+
+	recoverLast := func(seed int64) (encoding.BlockAffine, encoding.Block) {
+		last, rest, err := attacker.RecoverAffine(context.Background(), mrand.New(mrand.NewSource(seed)), Encoding{constr}, 8, generator)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rest.Encode([16]byte{}) != [16]byte{} {
+			t.Fatal("Rest of the cipher doesn't map zero to zero!")
+		} else if !encoding.ProbablyEquivalentBlocks(Encoding{constr}, encoding.ComposedBlocks{rest, last}) {
+			t.Fatal("Recovered layers don't compose to the cipher!")
+		}
+
+		return last, rest
+	}
+
+	last1, rest := recoverLast(1)
+	last2, _ := recoverLast(2)
+
+	if last1.BlockAdditive != last2.BlockAdditive {
+		t.Fatal("Recovered constants were different!")
+	}
+	for i := range last1.BlockLinear.Forwards {
+		if !bytes.Equal(last1.BlockLinear.Forwards[i], last2.BlockLinear.Forwards[i]) {
+			t.Fatal("Recovered linear parts were different!")
+		}
+	}
+
+	maps := make([]spn.AffineMap, 16)
+	for i := range maps {
+		maps[i] = spn.GenerateAffineMap(rand.Reader, 8)
+	}
+
+	last3, rest3 := ReparameterizeAffine(last1, rest, maps)
+	if !encoding.ProbablyEquivalentBlocks(Encoding{constr}, encoding.ComposedBlocks{rest3, last3}) {
+		t.Fatal("Reparameterized layers don't compose to the cipher!")
+	}
+}
+
+func TestDecomposeCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := NewAttacker(Options{Workers: 2}).DecomposeSPN(ctx, rand.Reader, spn.NewSPN(rand.Reader, spn.ASAS), spn.ASAS, spn.DefaultParams)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	if se, ok := err.(*StageError); !ok || se.Stage != LowRankDetection || se.Layer != 3 {
+		t.Fatalf("Cancelled in the wrong place: %v", err)
+	}
+}
+
+func TestFindPermutations(t *testing.T) {
+	sbox := spn.GenerateSBox(rand.Reader, 4)
+
+	function := func(f func(y int) bool) gfmatrix.Row {
+		row := gfmatrix.NewRow(16)
+		for y := range row {
+			if f(y) {
+				row[y] = 1
+			}
+		}
+		return row
+	}
+	bit := func(i uint) gfmatrix.Row {
+		return function(func(y int) bool { return sbox.DecKey[y]>>i&1 == 1 })
+	}
+
+	ones := function(func(y int) bool { return true })
+	basis := []gfmatrix.Row{ones, bit(0), bit(1), bit(2), bit(3)}
+
+	candidates, err := findPermutations(basis, 4, 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(candidates) != 1 || candidates[0][0] != 0 {
+		t.Fatalf("Expected one normalized candidate, got %v", candidates)
+	}
+
+	// The candidate doesn't depend on the basis of the solutions.
+	other := []gfmatrix.Row{bit(0).Add(ones), bit(1).Add(bit(0)), bit(2), bit(3).Add(bit(1)), ones}
+	if again, err := findPermutations(other, 4, 1); err != nil || fmt.Sprint(again) != fmt.Sprint(candidates) {
+		t.Fatalf("Candidate depends on the basis: %v, %v", again, err)
+	}
+
+	// Extra solutions give more candidates to search, including the right one.
+	extra := function(func(y int) bool { return mrand.Intn(2) == 1 })
+	if _, err := findPermutations(append(basis, extra), 4, 1); err != ErrTooManyCandidates {
+		t.Fatalf("Expected ErrTooManyCandidates, got %v", err)
+	}
+
+	more, err := findPermutations(append(basis, extra), 4, 31)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, candidate := range more {
+		found = found || fmt.Sprint(candidate) == fmt.Sprint(candidates[0])
+	}
+	if !found {
+		t.Fatal("Right candidate wasn't found among extra solutions!")
+	}
+
+	if _, err := findPermutations(basis[:4], 4, 1); err != ErrNoPermutation {
+		t.Fatalf("Expected ErrNoPermutation, got %v", err)
+	}
+}
+
+func TestAttacker(t *testing.T) {
+	constr := spn.NewSPN(rand.Reader, spn.SA)
+
+	opts := NewAttacker(Options{CubeAttempts: 10}).Options()
+	if opts.Workers != 1 || opts.CubeAttempts != 10 || opts.LowRankSamples != DefaultOptions.LowRankSamples {
+		t.Fatalf("Defaults weren't filled in: %+v", opts)
+	}
+
+	_, err := NewAttacker(opts).DecomposeSPN(context.Background(), rand.Reader, constr, spn.SA, spn.DefaultParams)
+	if se, ok := err.(*StageError); !ok || se.Stage != CubeAttack || se.Attempts != 10 || se.Err != ErrNotEnoughRelations {
+		t.Fatalf("Expected the cube attack to give up after 10 attempts, got %v", err)
+	}
+
+	// Stopping with too few relations leaves several S-boxes consistent with them, which isn't resolved by guessing.
+	params := spn.Params{BlockSize: 16, SBoxSize: 4}
+	nibbles := spn.NewSPNWithParams(rand.Reader, spn.SA, params)
+
+	_, err = NewAttacker(Options{CubeNullity: 8}).DecomposeSPN(context.Background(), rand.Reader, nibbles, spn.SA, params)
+	if se, ok := err.(*StageError); !ok || se.Stage != CubeAttack || se.Err != ErrAmbiguousSBox {
+		t.Fatalf("Expected the cube attack to find several S-boxes, got %v", err)
+	}
+
+	sets := 0
+	generator := func(rand io.Reader) [][16]byte {
+		sets++
+		return BalancedPlaintexts(8)(rand)
+	}
+
+	attacker := NewAttacker(Options{Generators: map[spn.Structure]Generator{spn.SA: generator}})
+	out, err := attacker.DecomposeSPN(context.Background(), rand.Reader, constr, spn.SA, spn.DefaultParams)
+	if err != nil {
+		t.Fatal(err)
+	} else if sets == 0 {
+		t.Fatal("The given generator wasn't used!")
+	} else if !encoding.ProbablyEquivalentBlocks(Encoding{constr}, Encoding{out}) {
+		t.Fatal("Incorrectly decomposed SA structure with the given generator!")
+	}
+}
+
+func TestObserver(t *testing.T) {
+	buf := &bytes.Buffer{}
+	reporter := NewJSONReporter(buf)
+
+	ctx := WithObserver(context.Background(), reporter)
+	_, err := NewAttacker(Options{Workers: 2}).DecomposeSPN(ctx, rand.Reader, spn.NewSPN(rand.Reader, spn.SA), spn.SA, spn.DefaultParams)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := reporter.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	events := []Event{}
+	for dec := json.NewDecoder(buf); dec.More(); {
+		event := Event{}
+		if err := dec.Decode(&event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+
+	if len(events) < 5 {
+		t.Fatalf("Expected at least 5 events, got %v", len(events))
+	}
+
+	first, last := events[0], events[len(events)-1]
+	if first.Kind != StageStarted || first.Stage != CubeAttack || first.Layer != 1 || first.Generator != "balanced plaintexts" {
+		t.Fatalf("Wrong first event: %+v", first)
+	} else if last.Kind != StageFinished || last.Stage != AffineDecomposition || last.Layer != 0 {
+		t.Fatalf("Wrong last event: %+v", last)
+	}
+
+	progress := events[len(events)-4]
+	if progress.Kind != RankProgress || progress.Stage != CubeAttack || progress.Layer != 1 || progress.Rank != progress.Target {
+		t.Fatalf("Wrong progress event: %+v", progress)
+	} else if progress.Queries == 0 || progress.Queries != 4*progress.Attempts {
+		t.Fatalf("Wrong number of queries: %+v", progress)
+	}
+}
+
+func TestDecomposeErrors(t *testing.T) {
+	ctx, attacker := context.Background(), NewAttacker(DefaultOptions)
+	constr := spn.NewSPN(rand.Reader, spn.SAS)
+
+	_, err := attacker.DecomposeSPN(ctx, rand.Reader, constr, spn.SAS, spn.Params{BlockSize: 8, SBoxSize: 8})
+	if err != ErrUnsupportedParams {
+		t.Fatalf("Expected ErrUnsupportedParams, got %v", err)
+	}
+
+	_, err = attacker.DecomposeSPN(ctx, rand.Reader, constr, spn.SAS, spn.Params{BlockSize: 16, SBoxSize: 16})
+	if err != ErrUnsupportedParams {
+		t.Fatalf("Expected ErrUnsupportedParams for 16-bit S-boxes, got %v", err)
+	}
+
+	// 6-bit S-boxes don't divide a 128-bit block.
+	sixBit := spn.Params{BlockSize: 12, SBoxSize: 6}
+
+	_, err = attacker.DecomposeSPN(ctx, rand.Reader, spn.NewSPNWithParams(rand.Reader, spn.SAS, sixBit), spn.SAS, sixBit)
+	if err != ErrUnsupportedParams {
+		t.Fatalf("Expected ErrUnsupportedParams for 6-bit S-boxes, got %v", err)
+	}
+
+	_, err = attacker.DecomposeSPN(ctx, rand.Reader, constr, "SASASAS", spn.DefaultParams)
+	if err != ErrUnknownStructure {
+		t.Fatalf("Expected ErrUnknownStructure, got %v", err)
+	}
+
+	// 8-bit ASASA is rejected before any queries are made.
+	oracle := NewOracle(spn.NewSPN(rand.Reader, spn.ASASA), 0)
+
+	_, err = attacker.DecomposeSPN(ctx, rand.Reader, oracle, spn.ASASA, spn.DefaultParams)
+	if err != ErrUnsupportedParams {
+		t.Fatalf("Expected ErrUnsupportedParams, got %v", err)
+	}
+
+	_, err = attacker.DecomposeTwoSidedSPN(ctx, rand.Reader, oracle, spn.ASASA, spn.DefaultParams)
+	if err != ErrUnsupportedParams {
+		t.Fatalf("Expected ErrUnsupportedParams, got %v", err)
+	}
+
+	// So is 8-bit SASASA, and ASASAS from both sides, which is peeled as SASASA.
+	_, err = attacker.DecomposeSPN(ctx, rand.Reader, oracle, "SASASA", spn.DefaultParams)
+	if err != ErrUnsupportedParams {
+		t.Fatalf("Expected ErrUnsupportedParams, got %v", err)
+	}
+
+	_, err = attacker.DecomposeTwoSidedSPN(ctx, rand.Reader, oracle, "ASASAS", spn.DefaultParams)
+	if err != ErrUnsupportedParams {
+		t.Fatalf("Expected ErrUnsupportedParams, got %v", err)
+	} else if oracle.Queries() != 0 {
+		t.Fatalf("Made %v queries before rejecting them", oracle.Queries())
+	}
+
+	small := spn.NewSmallSPN(rand.Reader, spn.SASAS)
+
+	_, err = DecomposeSmallSPNWithRand(rand.Reader, small, "SASASAS")
+	if err != ErrUnknownStructure {
+		t.Fatalf("Expected ErrUnknownStructure, got %v", err)
+	}
+
+	_, err = DecomposeSmallSPNWithRand(rand.Reader, small, spn.SA)
+	if err != ErrNoDecomposition {
+		t.Fatalf("Expected ErrNoDecomposition, got %v", err)
+	}
+}
+
+func TestQueryBudget(t *testing.T) {
+	constr := spn.NewSPN(rand.Reader, spn.SAS)
+
+	_, report, err := DecomposeSPNWithBudget(rand.Reader, constr, spn.SAS, spn.DefaultParams, 10)
+	if !errors.Is(err, ErrBudgetExceeded) {
+		t.Fatalf("Expected ErrBudgetExceeded, got %v", err)
+	}
+
+	se, ok := err.(*StageError)
+	if !ok || se.Stage != CubeAttack || se.Layer != 2 {
+		t.Fatalf("Budget ran out in the wrong place: %v", err)
+	}
+
+	if len(report) != 1 || report[0] != (StageQueries{CubeAttack, 2, 10}) {
+		t.Fatalf("Wrong query report: %v", report)
+	}
+}
+
+func TestStageBudget(t *testing.T) {
+	attacker := NewAttacker(DefaultOptions)
+	oracle := NewOracle(spn.NewSPN(rand.Reader, spn.SA), 10)
+
+	_, _, err := attacker.RecoverSBoxes(context.Background(), rand.Reader, Encoding{oracle}, 8, BalancedPlaintexts(4))
+	if err != ErrBudgetExceeded {
+		t.Fatalf("Expected ErrBudgetExceeded, got %v", err)
+	}
+
+	oracle = NewOracle(spn.NewSPN(rand.Reader, spn.AS), 10)
+
+	_, _, err = RecoverAffine(context.Background(), rand.Reader, Encoding{oracle}, 8, 2, attacker.trivialSubspaces)
+	if err != ErrBudgetExceeded {
+		t.Fatalf("Expected ErrBudgetExceeded, got %v", err)
+	}
+}
+
+func TestQueryReport(t *testing.T) {
+	constr := spn.NewSPN(rand.Reader, spn.AS)
+	out, report, err := DecomposeSPNWithBudget(rand.Reader, constr, spn.AS, spn.DefaultParams, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok := encoding.ProbablyEquivalentBlocks(
+		Encoding{constr},
+		Encoding{out},
+	)
+	if !ok {
+		t.Fatal("Incorrectly decomposed AS structure!")
+	}
+
+	if len(report) != 2 || report[0].Stage != TrivialSubspaces || report[1].Stage != SBoxDecomposition {
+		t.Fatalf("Wrong stages in query report: %v", report)
+	}
+
+	if report[1].Queries != 256*16 {
+		t.Fatalf("S-box decomposition made %v queries, expected %v", report[1].Queries, 256*16)
+	}
+}
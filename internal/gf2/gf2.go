@@ -0,0 +1,54 @@
+// Package gf2 holds the bit-level helpers that constructions/spn and cryptanalysis/spn both use to treat blocks as
+// vectors over GF(2).
+package gf2
+
+import (
+	"github.com/OpenWhiteBox/primitives/matrix"
+)
+
+// GetChunk returns the width bits of block starting at bit offset. Bit i of a block is bit i%8 of byte i/8, matching
+// constructions/spn.SBoxLayer.
+func GetChunk(block []byte, offset, width int) (out uint16) {
+	for i := 0; i < width; i++ {
+		bit := offset + i
+		out |= uint16((block[bit/8]>>uint(bit%8))&1) << uint(i)
+	}
+
+	return
+}
+
+// SetChunk sets the width bits of block starting at bit offset to x.
+func SetChunk(block []byte, offset, width int, x uint16) {
+	for i := 0; i < width; i++ {
+		bit := offset + i
+		block[bit/8] &^= 1 << uint(bit%8)
+		block[bit/8] |= byte((x>>uint(i))&1) << uint(bit%8)
+	}
+}
+
+// ReducedRows returns the reduced row echelon form of rows, with pivots at the lowest set bit of each row. rows isn't
+// modified.
+func ReducedRows(rows matrix.Matrix) matrix.Matrix {
+	out := rows.Dup()
+
+	r := 0
+	for c := 0; c < out[0].Size() && r < len(out); c++ {
+		p := r
+		for p < len(out) && out[p].GetBit(c) == 0 {
+			p++
+		}
+		if p == len(out) {
+			continue
+		}
+
+		out[r], out[p] = out[p], out[r]
+		for i := range out {
+			if i != r && out[i].GetBit(c) == 1 {
+				out[i] = out[i].Add(out[r])
+			}
+		}
+		r++
+	}
+
+	return out
+}
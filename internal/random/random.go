@@ -0,0 +1,38 @@
+// Package random holds the helpers that constructions/spn and cryptanalysis/spn both read their random choices with.
+package random
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"io"
+)
+
+// ReadFull fills buf from the random source. It panics if the source fails or runs out, rather than leaving part of buf
+// zero.
+func ReadFull(rand io.Reader, buf []byte) {
+	if _, err := io.ReadFull(rand, buf); err != nil {
+		panic("Failed to read from random source!")
+	}
+}
+
+// KeyStream returns the AES-CTR keystream under key, with an all-zero IV, as a random source. It returns an error if key
+// isn't a valid AES key.
+func KeyStream(key []byte) (io.Reader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.StreamReader{S: cipher.NewCTR(block, make([]byte, aes.BlockSize)), R: zeros{}}, nil
+}
+
+// zeros is an infinite source of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+
+	return len(p), nil
+}